@@ -0,0 +1,460 @@
+package backends
+
+import (
+	"os"
+	"fmt"
+	"io"
+	"strings"
+	"strconv"
+	"sort"
+	"os/exec"
+	"github.com/vaughan0/go-logging"
+	"github.com/kylelemons/go-gypsy/yaml"
+)
+
+
+// Backends store (or otherwise output) tags for paths, produced by taggers.
+// Tag calls can be buffered in any way, but all of them must be
+//  applied by the time Flush returns, which is called after each root path.
+type Backend interface {
+	// Called once before any paths are processed.
+	Open() error
+	// Attach namespaced tags (e.g. "lang:go") to a file path, with info from lstat() on it.
+	Tag(path string, info os.FileInfo, tags []string) error
+	// Apply all pending changes.
+	Flush() error
+	// Flush and release all resources, backend won't be used after that.
+	Close() error
+}
+
+// Backends that can remove tags which weren't produced on this run from
+//  namespaces that are managed by codetag, but only from processed paths.
+type Syncer interface {
+	// Enable sync mode for specified (non-empty) namespaces, called before Open.
+	Sync(namespaces []string) error
+}
+
+// Backends that can report changes that would've been made, without making them.
+type Differ interface {
+	// Enable diff mode with report written to specified output, called before Open.
+	// Report should be finished by the time Close returns.
+	Diff(out io.Writer) error
+}
+
+// Backend before it is configured with "name" and "config".
+// Config is the whole "output" section map, so backends can pick their options from it.
+type backend_ctor func(name string, config yaml.Map, log *logging.Logger) (Backend, error)
+
+
+// Configure and return named Backend.
+func Get(name string, config yaml.Map, log *logging.Logger) (Backend, error) {
+	ctor, ok := backends[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown backend type: %v", name)
+	}
+	if config == nil {
+		config = yaml.Map{}
+	}
+	return ctor(name, config, log)
+}
+
+// Return sorted names of all available backends.
+func Names() (names []string) {
+	for name, _ := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// Get positive integer value from config map, using default if it's not set there.
+func config_int(config yaml.Map, key string, value int) (int, error) {
+	node, ok := config[key]
+	if !ok {
+		return value, nil
+	}
+	val, ok := node.(yaml.Scalar)
+	n, err := strconv.Atoi(string(val))
+	if !ok || err != nil || n <= 0 {
+		return value, fmt.Errorf("'%v' must be a positive integer: %v", key, node)
+	}
+	return n, nil
+}
+
+
+// Writer which line-buffers data, passing each line to log_func
+type log_pipe struct {
+	log_func func(string)
+	buff string ""
+}
+
+func (pipe *log_pipe) Log(line string) {
+	pipe.log_func(strings.TrimSpace(line))
+}
+
+func (pipe *log_pipe) Write(p []byte) (n int, err error) {
+	pipe.buff += string(p)
+	for strings.Contains(pipe.buff, "\n") {
+		lines := strings.SplitN(pipe.buff, "\n", 2)
+		pipe.Log(lines[0])
+		pipe.buff = lines[1]
+	}
+	return len(p), nil
+}
+
+func (pipe *log_pipe) Flush() {
+	if len(pipe.buff) > 0 {
+		pipe.Log(pipe.buff)
+	}
+	pipe.buff = ""
+}
+
+
+// Doesn't store tags anywhere, used for --dry-run.
+type backend_none struct{}
+
+func (backend *backend_none) Open() error { return nil }
+func (backend *backend_none) Tag(path string, info os.FileInfo, tags []string) error { return nil }
+func (backend *backend_none) Flush() error { return nil }
+func (backend *backend_none) Close() error { return nil }
+
+func (backend *backend_none) Sync(namespaces []string) error { return nil }
+
+func backend_none_ctor(name string, config yaml.Map, log *logging.Logger) (Backend, error) {
+	return &backend_none{}, nil
+}
+
+
+// Groups files with identical tag sets, running tmsu once per batch of these.
+type tmsu_batch struct {
+	cmd string
+	tags string
+	files []string
+	size int
+}
+
+// Files (with new tags) to query current tags for, in sync mode.
+type tmsu_sync_file struct {
+	path string
+	tags []string
+}
+
+type backend_tmsu struct {
+	log *logging.Logger
+	pipe *log_pipe
+	// Limits on number of files and total length of their paths per tmsu run
+	max_files, max_bytes int
+	batches map[string]*tmsu_batch
+	// Managed namespaces, if running in sync mode
+	sync_ns map[string]bool
+	sync_files []tmsu_sync_file
+	sync_size int
+	// Output for the changes report, if running in diff mode
+	diff io.Writer
+	diff_files, diff_changed, diff_added, diff_removed int
+}
+
+func backend_tmsu_ctor(name string, config yaml.Map, log *logging.Logger) (Backend, error) {
+	var err error
+	backend := backend_tmsu{log: log, batches: make(map[string]*tmsu_batch)}
+	backend.max_files, err = config_int(config, "batch_files", 1000)
+	if err != nil {
+		return nil, err
+	}
+	backend.max_bytes, err = config_int(config, "batch_bytes", 100000)
+	if err != nil {
+		return nil, err
+	}
+	log_tmsu := logging.Get("codetag.tmsu")
+	backend.pipe = &log_pipe{log_func: func(line string) { log_tmsu.Debug(line) }}
+	return &backend, nil
+}
+
+func (backend *backend_tmsu) Open() error {
+	return nil
+}
+
+func (backend *backend_tmsu) Sync(namespaces []string) error {
+	backend.sync_ns = make(map[string]bool, len(namespaces))
+	for _, ns := range namespaces {
+		backend.sync_ns[ns] = true
+	}
+	return nil
+}
+
+func (backend *backend_tmsu) Diff(out io.Writer) error {
+	backend.diff = out
+	return nil
+}
+
+func (backend *backend_tmsu) Tag(path string, info os.FileInfo, tags []string) (err error) {
+	if backend.sync_ns != nil || backend.diff != nil {
+		if len(backend.sync_files) > 0 && (
+				len(backend.sync_files) >= backend.max_files ||
+				backend.sync_size + len(path) > backend.max_bytes) {
+			err = backend.sync()
+		}
+		backend.sync_files = append(backend.sync_files, tmsu_sync_file{path, tags})
+		backend.sync_size += len(path) + 1
+	}
+	if backend.diff == nil {
+		err_batch := backend.batch("tag", path, tags)
+		if err == nil {
+			err = err_batch
+		}
+	}
+	return
+}
+
+// Add path to a batch for tmsu command with the same tags, running it if limits are reached.
+func (backend *backend_tmsu) batch(cmd, path string, tags []string) (err error) {
+	if len(tags) == 0 {
+		return
+	}
+	tags = append([]string{}, tags...)
+	sort.Strings(tags)
+	tags_str := tmsu_tags_join(tags)
+	key := cmd + " " + tags_str
+	batch, ok := backend.batches[key]
+	if !ok {
+		batch = &tmsu_batch{cmd: cmd, tags: tags_str}
+		backend.batches[key] = batch
+	}
+	if len(batch.files) > 0 && (
+			len(batch.files) >= backend.max_files ||
+			batch.size + len(path) > backend.max_bytes) {
+		err = backend.run(batch)
+	}
+	batch.files = append(batch.files, path)
+	batch.size += len(path) + 1
+	return
+}
+
+func (backend *backend_tmsu) run(batch *tmsu_batch) (err error) {
+	// Symlinks are only passed here to tag links themselves, followed ones - by resolved paths
+	cmd := exec.Command("tmsu", batch.cmd, "--no-dereference", "--tags=" + batch.tags, "--")
+	cmd.Args = append(cmd.Args, batch.files...)
+	cmd.Stdout, cmd.Stderr = backend.pipe, backend.pipe
+	err = cmd.Run()
+	backend.pipe.Flush()
+	if err != nil {
+		err = fmt.Errorf("Failure running tmsu %v (tags: %v, files: %v): %v",
+			batch.cmd, batch.tags, batch.files, err)
+	}
+	batch.files, batch.size = batch.files[:0], 0
+	return
+}
+
+var tmsu_tag_escape = strings.NewReplacer(`\`, `\\`, " ", `\ `)
+
+// Join tag names for --tags option, backslash-escaping spaces in these, same as tmsu does.
+func tmsu_tags_join(tags []string) string {
+	escaped := make([]string, len(tags))
+	for n, tag := range tags {
+		escaped[n] = tmsu_tag_escape.Replace(tag)
+	}
+	return strings.Join(escaped, " ")
+}
+
+// Unescape tag names in "tmsu tags" output, where spaces and such are backslash-escaped.
+func tmsu_tags_split(line string) (tags []string) {
+	tag, escaped := []rune{}, false
+	for _, c := range line {
+		switch {
+			case escaped:
+				tag, escaped = append(tag, c), false
+			case c == '\\':
+				escaped = true
+			case c == ' ':
+				if len(tag) > 0 {
+					tags, tag = append(tags, string(tag)), []rune{}
+				}
+			default:
+				tag = append(tag, c)
+		}
+	}
+	if len(tag) > 0 {
+		tags = append(tags, string(tag))
+	}
+	return
+}
+
+// Query current explicit tags for a list of files from tmsu.
+func (backend *backend_tmsu) query(paths []string) (tags map[string][]string, err error) {
+	cmd := exec.Command("tmsu", "tags", "--explicit", "--no-dereference", "--name=always", "--")
+	cmd.Args = append(cmd.Args, paths...)
+	cmd.Stderr = backend.pipe
+	out, err := cmd.Output()
+	backend.pipe.Flush()
+	if err != nil {
+		return nil, fmt.Errorf("Failure running tmsu tags (files: %v): %v", paths, err)
+	}
+	// Output is "path: tag1 tag2 ..." lines, in the same order as paths
+	tags = make(map[string][]string, len(paths))
+	n := 0
+	for _, line := range strings.Split(string(out), "\n") {
+		if len(line) == 0 {
+			continue
+		}
+		if n >= len(paths) || !strings.HasPrefix(line, paths[n] + ":") {
+			n = -1
+			for m, path := range paths {
+				if strings.HasPrefix(line, path + ":") {
+					n = m
+					break
+				}
+			}
+			if n < 0 {
+				backend.log.Warnf("Failed to match tmsu tags output line to any path: %q", line)
+				n = len(paths)
+				continue
+			}
+		}
+		tags[paths[n]] = tmsu_tags_split(line[len(paths[n]) + 1:])
+		n++
+	}
+	return
+}
+
+// Get new tags that aren't set for the file yet.
+func (backend *backend_tmsu) added_tags(tags_old, tags_new []string) (tags []string) {
+	tags_set := make(map[string]bool, len(tags_old))
+	for _, tag := range tags_old {
+		tags_set[tag] = true
+	}
+	for _, tag := range tags_new {
+		if !tags_set[tag] {
+			tags_set[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	return
+}
+
+// Get tags in managed namespaces, that are set for the file, but not in the new tags.
+func (backend *backend_tmsu) stale_tags(tags_old, tags_new []string) (tags []string) {
+	tags_set := make(map[string]bool, len(tags_new))
+	for _, tag := range tags_new {
+		tags_set[tag] = true
+	}
+	for _, tag := range tags_old {
+		parts := strings.SplitN(tag, ":", 2)
+		if len(parts) < 2 || !backend.sync_ns[parts[0]] || tags_set[tag] {
+			continue
+		}
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return
+}
+
+// Print line for the file to the diff report, if there are any changes.
+func (backend *backend_tmsu) diff_report(path string, added, removed []string) (err error) {
+	backend.diff_files++
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+	backend.diff_changed++
+	backend.diff_added += len(added)
+	backend.diff_removed += len(removed)
+	line := path + ":"
+	for _, tag := range added {
+		line += " +" + tag
+	}
+	for _, tag := range removed {
+		line += " -" + tag
+	}
+	_, err = fmt.Fprintln(backend.diff, line)
+	return
+}
+
+// Query current tags for pending files, and either batch
+//  untagging of stale ones or report all changes in diff mode.
+func (backend *backend_tmsu) sync() (err error) {
+	if len(backend.sync_files) == 0 {
+		return
+	}
+	paths := make([]string, len(backend.sync_files))
+	for n, file := range backend.sync_files {
+		paths[n] = file.path
+	}
+	tags_old, err := backend.query(paths)
+	if err == nil {
+		for _, file := range backend.sync_files {
+			var tags []string
+			if backend.sync_ns != nil {
+				tags = backend.stale_tags(tags_old[file.path], file.tags)
+			}
+			if backend.diff != nil {
+				err = backend.diff_report(file.path,
+					backend.added_tags(tags_old[file.path], file.tags), tags)
+				if err != nil {
+					break
+				}
+				continue
+			}
+			if len(tags) == 0 {
+				continue
+			}
+			backend.log.Debugf("Removing stale tags (file: %v): %v", file.path, tags)
+			err_batch := backend.batch("untag", file.path, tags)
+			if err == nil {
+				err = err_batch
+			}
+		}
+	}
+	backend.sync_files, backend.sync_size = backend.sync_files[:0], 0
+	return
+}
+
+// Run tmsu for all pending batches.
+func (backend *backend_tmsu) Flush() (err error) {
+	err = backend.sync()
+	if err != nil {
+		backend.log.Error(err)
+		err = fmt.Errorf("Failed to remove stale tags")
+	}
+	keys := make([]string, 0, len(backend.batches))
+	for key, _ := range backend.batches {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		batch := backend.batches[key]
+		if len(batch.files) == 0 {
+			continue
+		}
+		err_run := backend.run(batch)
+		if err_run != nil {
+			backend.log.Error(err_run)
+			err = fmt.Errorf("Some of the tmsu runs have failed")
+		}
+	}
+	backend.batches = make(map[string]*tmsu_batch)
+	return
+}
+
+func (backend *backend_tmsu) Close() (err error) {
+	err = backend.Flush()
+	if backend.diff != nil {
+		_, err_diff := fmt.Fprintf(backend.diff,
+			"Total: %d file(s) changed (of %d processed), %d tag(s) added, %d removed\n",
+			backend.diff_changed, backend.diff_files, backend.diff_added, backend.diff_removed)
+		if err == nil {
+			err = err_diff
+		}
+	}
+	return
+}
+
+
+// Map of available Backend constructors
+var backends = map[string]backend_ctor {
+	"none": backend_none_ctor,
+	"tmsu": backend_tmsu_ctor,
+	"jsonl": backend_jsonl_ctor,
+	"tsv": backend_tsv_ctor,
+	"tree": backend_tree_ctor,
+	"index": backend_index_ctor,
+}
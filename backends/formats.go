@@ -0,0 +1,156 @@
+package backends
+
+import (
+	"os"
+	"io"
+	"bufio"
+	"strings"
+	"path/filepath"
+	"encoding/json"
+	"github.com/vaughan0/go-logging"
+	"github.com/kylelemons/go-gypsy/yaml"
+)
+
+
+// Backends that print tags to stdout in some machine- or human-readable format.
+type backend_stdout struct {
+	out *bufio.Writer
+}
+
+func (backend *backend_stdout) Open() error {
+	backend.out = bufio.NewWriter(os.Stdout)
+	return nil
+}
+
+func (backend *backend_stdout) Flush() error {
+	return backend.out.Flush()
+}
+
+func (backend *backend_stdout) Close() error {
+	return backend.Flush()
+}
+
+
+// JSON Lines, one {"path": ..., "tags": [{"ns": ..., "value": ...}, ...]} object per file.
+type backend_jsonl struct {
+	backend_stdout
+	enc *json.Encoder
+}
+
+type jsonl_tag struct {
+	NS string `json:"ns"`
+	Value string `json:"value"`
+}
+
+type jsonl_record struct {
+	Path string `json:"path"`
+	Tags []jsonl_tag `json:"tags"`
+}
+
+func backend_jsonl_ctor(name string, config yaml.Map, log *logging.Logger) (Backend, error) {
+	return &backend_jsonl{}, nil
+}
+
+func (backend *backend_jsonl) Open() (err error) {
+	err = backend.backend_stdout.Open()
+	backend.enc = json.NewEncoder(backend.out)
+	backend.enc.SetEscapeHTML(false)
+	return
+}
+
+func (backend *backend_jsonl) Tag(path string, info os.FileInfo, tags []string) error {
+	record := jsonl_record{Path: path, Tags: make([]jsonl_tag, len(tags))}
+	for n, tag := range tags {
+		parts := strings.SplitN(tag, ":", 2)
+		if len(parts) < 2 {
+			parts = []string{"", tag}
+		}
+		record.Tags[n] = jsonl_tag{parts[0], parts[1]}
+	}
+	return backend.enc.Encode(record)
+}
+
+
+// "tag1 tag2 ...<tab>path<nul>" records, so that paths can contain any characters.
+type backend_tsv struct {
+	backend_stdout
+}
+
+func backend_tsv_ctor(name string, config yaml.Map, log *logging.Logger) (Backend, error) {
+	return &backend_tsv{}, nil
+}
+
+func (backend *backend_tsv) Tag(path string, info os.FileInfo, tags []string) (err error) {
+	_, err = io.WriteString(backend.out, strings.Join(tags, " ") + "\t" + path + "\x00")
+	return
+}
+
+
+// Indented tree of files under common parent dir, printed for each of the root paths.
+type tree_file struct {
+	path string
+	tags []string
+}
+
+type backend_tree struct {
+	backend_stdout
+	files []tree_file
+}
+
+func backend_tree_ctor(name string, config yaml.Map, log *logging.Logger) (Backend, error) {
+	return &backend_tree{}, nil
+}
+
+func (backend *backend_tree) Tag(path string, info os.FileInfo, tags []string) error {
+	backend.files = append(backend.files, tree_file{path, tags})
+	return nil
+}
+
+func (backend *backend_tree) Flush() (err error) {
+	if len(backend.files) == 0 {
+		return backend.out.Flush()
+	}
+
+	// Find common parent dir
+	base := filepath.Dir(backend.files[0].path)
+	for _, file := range backend.files {
+		for base != filepath.Dir(base) && !strings.HasPrefix(file.path, base + string(filepath.Separator)) {
+			base = filepath.Dir(base)
+		}
+	}
+	base_prefix := base
+	if !strings.HasSuffix(base_prefix, string(filepath.Separator)) {
+		base_prefix += string(filepath.Separator)
+	}
+	_, err = io.WriteString(backend.out, base_prefix + "\n")
+
+	dirs_prev := []string{}
+	for _, file := range backend.files {
+		if err != nil {
+			break
+		}
+		dirs := strings.Split(strings.TrimPrefix(file.path, base_prefix), string(filepath.Separator))
+		name, dirs := dirs[len(dirs)-1], dirs[:len(dirs)-1]
+		n := 0
+		for n < len(dirs) && n < len(dirs_prev) && dirs[n] == dirs_prev[n] {
+			n++
+		}
+		for ; n < len(dirs); n++ {
+			_, err = io.WriteString(backend.out, strings.Repeat("  ", n + 1) + dirs[n] + "/\n")
+		}
+		dirs_prev = dirs
+		_, err = io.WriteString(backend.out, strings.Repeat("  ", len(dirs) + 1) +
+			name + "  [" + strings.Join(file.tags, " ") + "]\n")
+	}
+
+	backend.files = backend.files[:0]
+	err_flush := backend.out.Flush()
+	if err == nil {
+		err = err_flush
+	}
+	return
+}
+
+func (backend *backend_tree) Close() error {
+	return backend.Flush()
+}
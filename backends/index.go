@@ -0,0 +1,89 @@
+package backends
+
+import (
+	"os"
+	"fmt"
+	"sort"
+	"strings"
+	"github.com/vaughan0/go-logging"
+	"github.com/kylelemons/go-gypsy/yaml"
+	"codetag/index"
+)
+
+
+// Stores tags in codetag's own on-disk index, which can be queried via "codetag files".
+// "index_path" option should be already expanded by the caller.
+type backend_index struct {
+	log *logging.Logger
+	path string
+	idx *index.Index
+	sync_ns map[string]bool
+}
+
+func backend_index_ctor(name string, config yaml.Map, log *logging.Logger) (Backend, error) {
+	backend := backend_index{log: log, path: index.PathDefault}
+	node, ok := config["index_path"]
+	if ok {
+		path, ok := node.(yaml.Scalar)
+		if !ok {
+			return nil, fmt.Errorf("'index_path' must be a string: %v", node)
+		}
+		backend.path = string(path)
+	}
+	return &backend, nil
+}
+
+func (backend *backend_index) Open() (err error) {
+	backend.idx, err = index.Load(backend.path)
+	return
+}
+
+func (backend *backend_index) Sync(namespaces []string) error {
+	backend.sync_ns = make(map[string]bool, len(namespaces))
+	for _, ns := range namespaces {
+		backend.sync_ns[ns] = true
+	}
+	return nil
+}
+
+func (backend *backend_index) Tag(path string, info os.FileInfo, tags []string) error {
+	tags_set := make(map[string]bool, len(tags))
+	tags_new := []string{}
+	for _, tag := range tags {
+		if !tags_set[tag] {
+			tags_set[tag] = true
+			tags_new = append(tags_new, tag)
+		}
+	}
+	entry, ok := backend.idx.Entries[path]
+	if ok {
+		// Keep old tags, unless these are in managed namespaces in sync mode
+		for _, tag := range entry.Tags {
+			if tags_set[tag] {
+				continue
+			}
+			parts := strings.SplitN(tag, ":", 2)
+			if len(parts) == 2 && backend.sync_ns[parts[0]] {
+				continue
+			}
+			tags_set[tag] = true
+			tags_new = append(tags_new, tag)
+		}
+	}
+	sort.Strings(tags_new)
+	backend.idx.Set(path, &index.Entry{
+		Tags: tags_new, Mtime: info.ModTime().UnixNano(), Size: info.Size() })
+	return nil
+}
+
+func (backend *backend_index) Flush() error {
+	return backend.idx.Save()
+}
+
+func (backend *backend_index) Close() error {
+	n := backend.idx.Prune()
+	if n > 0 {
+		backend.log.Debugf("Removed %d non-existent path(s) from index", n)
+	}
+	return backend.idx.Save()
+}
@@ -0,0 +1,183 @@
+package cache
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"sync"
+	"syscall"
+	"hash/fnv"
+	"path/filepath"
+	"encoding/gob"
+	"encoding/binary"
+)
+
+
+// State of the path from the previous run, to skip re-processing unchanged ones.
+type Entry struct {
+	Mtime int64
+	Size int64
+	Ino uint64
+	// Fingerprint of context inputs for the path and all its parent dirs
+	Ctx uint64
+	// Resulting tags for files
+	Tags []string
+	// Resulting context tags for each namespace, for directories
+	CtxTags map[string][]string
+}
+
+// Persistent state cache, keyed by path, safe for concurrent use.
+// Key is an arbitrary string (e.g. hash of configuration), and if it doesn't
+//  match the one stored on disk, cache is discarded.
+type Cache struct {
+	lock sync.Mutex
+	Path string
+	Key string
+	Entries map[string]*Entry
+	// Entries set since last Commit
+	pending map[string]*Entry
+	// Paths that were used or updated on this run
+	seen map[string]bool
+}
+
+type cache_file struct {
+	Key string
+	Entries map[string]*Entry
+}
+
+// Load cache from specified path, returning empty one if it
+//  doesn't exist yet or was created with different key.
+func Load(path, key string) (cache *Cache, err error) {
+	cache = &Cache{Path: path, Key: key, Entries: make(map[string]*Entry),
+		pending: make(map[string]*Entry), seen: make(map[string]bool)}
+	src, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	defer src.Close()
+	data := cache_file{}
+	err = gob.NewDecoder(src).Decode(&data)
+	if err == io.EOF {
+		return cache, nil
+	}
+	if err != nil {
+		return cache, fmt.Errorf("Failed to decode cache file (%v): %v", path, err)
+	}
+	if data.Key == key && data.Entries != nil {
+		cache.Entries = data.Entries
+	}
+	return
+}
+
+// Write cache to a temporary file, then rename it over the old one.
+// Entries that weren't used on this run are dropped if paths don't exist anymore.
+func (cache *Cache) Save() (err error) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	for path, _ := range cache.Entries {
+		if cache.seen[path] {
+			continue
+		}
+		_, err := os.Lstat(path)
+		if err != nil && os.IsNotExist(err) {
+			delete(cache.Entries, path)
+		}
+	}
+	dst, err := os.CreateTemp(filepath.Dir(cache.Path), "." + filepath.Base(cache.Path) + ".*.tmp")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			dst.Close()
+			os.Remove(dst.Name())
+		}
+	}()
+	err = gob.NewEncoder(dst).Encode(cache_file{cache.Key, cache.Entries})
+	if err != nil {
+		return
+	}
+	err = dst.Close()
+	if err != nil {
+		return
+	}
+	return os.Rename(dst.Name(), cache.Path)
+}
+
+func file_ino(info os.FileInfo) uint64 {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0
+	}
+	return uint64(stat.Ino)
+}
+
+// Return entry for the path, if it wasn't changed since it was stored.
+func (cache *Cache) Get(path string, info os.FileInfo, ctx uint64) *Entry {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	entry, ok := cache.Entries[path]
+	if !ok || entry.Ctx != ctx || entry.Size != info.Size() ||
+			entry.Mtime != info.ModTime().UnixNano() || entry.Ino != file_ino(info) {
+		return nil
+	}
+	cache.seen[path] = true
+	return entry
+}
+
+// Store new state for the path, which will only be used after Commit.
+func (cache *Cache) Set(path string, info os.FileInfo, ctx uint64, entry *Entry) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	entry.Mtime, entry.Size, entry.Ino, entry.Ctx =
+		info.ModTime().UnixNano(), info.Size(), file_ino(info), ctx
+	cache.pending[path] = entry
+	cache.seen[path] = true
+}
+
+// Store all pending entries, e.g. after their tags were successfully applied.
+func (cache *Cache) Commit() {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	for path, entry := range cache.pending {
+		cache.Entries[path] = entry
+	}
+	cache.pending = make(map[string]*Entry)
+}
+
+// Drop all pending entries, so these paths will be processed again on the next run.
+func (cache *Cache) Discard() {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	for path, _ := range cache.pending {
+		delete(cache.Entries, path)
+	}
+	cache.pending = make(map[string]*Entry)
+}
+
+
+// Fingerprint of context inputs (paths relative to dir, with lstat() info returned
+//  by stat func) for the directory, chained with the one for its parent dir,
+//  so that it'll change if any of inputs for this directory or any of its parents change.
+func CtxFingerprint(parent uint64, inputs []string, stat func(input string) (os.FileInfo, bool)) uint64 {
+	hash, buff := fnv.New64a(), make([]byte, 8)
+	binary.LittleEndian.PutUint64(buff, parent)
+	hash.Write(buff)
+	for _, input := range inputs {
+		hash.Write([]byte(input + "\x00"))
+		info, ok := stat(input)
+		if !ok {
+			hash.Write([]byte{0})
+			continue
+		}
+		for _, n := range []uint64{
+				uint64(info.ModTime().UnixNano()), uint64(info.Size()), file_ino(info) } {
+			binary.LittleEndian.PutUint64(buff, n)
+			hash.Write(buff)
+		}
+	}
+	return hash.Sum64()
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"strconv"
+	"os"
+	"path/filepath"
+	"hash/fnv"
+	"github.com/vaughan0/go-logging"
+	"github.com/kylelemons/go-gypsy/yaml"
+	"codetag/log_setup"
+	tgrs "codetag/taggers"
+	"codetag/backends"
+	"codetag/index"
+)
+
+
+// Traversal options, which can be set in "scan" section or for specific paths.
+type scan_opts struct {
+	// Skip paths listed in .gitignore, .hgignore and such
+	vcs_ignore bool
+	// Skip files in git repositories that aren't in git index
+	git_index bool
+	// Skip dirs with CACHEDIR.TAG files
+	cachedir_tag bool
+	// Descend into symlinked dirs and tag resolved paths of symlinked files
+	follow_symlinks bool
+	// Tag symlinks themselves with "link:symlink"
+	symlink_tag bool
+	// Don't descend into dirs on other filesystems
+	xdev bool
+}
+
+// Parse traversal options from a map, overriding ones that are set there.
+func (opts *scan_opts) parse(conf yaml.Map, section string) {
+	for key, dst := range map[string]*bool{"vcs_ignore": &opts.vcs_ignore,
+			"git_index": &opts.git_index, "cachedir_tag": &opts.cachedir_tag,
+			"follow_symlinks": &opts.follow_symlinks, "symlink_tag": &opts.symlink_tag,
+			"xdev": &opts.xdev} {
+		node, ok := conf[key]
+		if !ok {
+			continue
+		}
+		val, ok := node.(yaml.Scalar)
+		if !ok || (val != "true" && val != "false") {
+			panic(fmt.Errorf("'%v.%v' must be either true or false: %v", section, key, node))
+		}
+		*dst = val == "true"
+	}
+}
+
+
+// Everything that is initialized from the configuration file.
+type config_t struct {
+	path string
+	log *logging.Logger
+	filters path_filters
+	paths []string
+	scan scan_opts
+	// Options set for specific paths, overriding ones in "scan" section
+	paths_scan map[string]scan_opts
+	// Names of marker files, which exclude dirs that contain them
+	markers []string
+	// Namespaces defined under "taggers", except for "_none"
+	namespaces []string
+	taggers map[string][]*tgrs.Tagger
+	backend_name string
+	backend backends.Backend
+	index_path string
+	// State cache is only loaded for scans, as it can be large
+	cache_path, cache_key string
+}
+
+// Read and process configuration file, initializing logging, taggers and output backend.
+// Can be called again to re-read configuration (e.g. on SIGHUP).
+// Returned log_init flag indicates whether logging was configured, even if there was an error.
+func config_load(config_path string) (config *config_t, log_init bool, err error) {
+	config = &config_t{path: config_path}
+
+	defer func() {
+		// Config processing uses panics for any issues in there
+		if err_panic := recover(); err_panic != nil {
+			config, err = nil, fmt.Errorf("%v", err_panic)
+		}
+	}()
+
+	// Read the config as yaml
+	config_yaml, err := yaml.ReadFile(config_path)
+	if err != nil {
+		panic(err)
+	}
+
+	// Configure logging
+	log := logging.Get("codetag")
+	config.log = log
+
+	// Common processing vars
+	var (
+		ok bool
+		node yaml.Node
+		config_map yaml.Map
+		config_list yaml.List
+	)
+
+	node, err = yaml.Child(config_yaml.Root, ".logging")
+	if err != nil || node == nil {
+		logging.DefaultSetup()
+		log.Debugf("No logging config defined (err: %#v), using defaults", err)
+	} else {
+		config_map, ok = node.(yaml.Map)
+		if !ok {
+			logging.DefaultSetup()
+			log.Error("'logging' config section is not a map, ignoring")
+		} else {
+			err = log_setup.SetupYAML(config_map)
+			if err != nil {
+				logging.DefaultSetup()
+				log.Errorf("Failed to configure logging: %v", err)
+			}
+		}
+	}
+
+	log_init = true
+
+	// Configure filtering
+	filters := path_filters{}
+	node, err = yaml.Child(config_yaml.Root, ".filter")
+	if err != nil || node == nil {
+		log.Debug("No path-filters configured")
+	} else {
+		config_list, ok = node.(yaml.List)
+		if !ok {
+			panic(fmt.Errorf("'filters' must be a list of string patterns"))
+		}
+		for _, node := range config_list {
+			rule, ok := node.(yaml.Scalar)
+			if !ok {
+				log.Errorf("Filter rule must be a string: %v", node)
+				continue
+			}
+			rule_str := strings.Trim(string(rule), "'")
+			rule_filters, err := filter_parse(rule_str, "", filepath.Dir(config_path))
+			if err != nil {
+				log.Errorf("Failed to parse filter rule (%v): %v", rule_str, err)
+				continue
+			}
+			filters = append(filters, rule_filters...)
+		}
+	}
+	// Per-directory filter files are merged-in before all other rules by default
+	merge_default := true
+	for _, name := range filters.merge_names() {
+		merge_default = merge_default && name != filter_file_default
+	}
+	if merge_default {
+		filters = append(path_filters{{rule: ": " + filter_file_default,
+			merge: filter_file_default}}, filters...)
+	}
+	config.filters = filters
+
+	// Get the list of paths to process, which can also be maps with "path" key and scan_opts
+	config_map, ok = config_yaml.Root.(yaml.Map)
+	if !ok {
+		panic(fmt.Errorf("Config must be a map and have 'paths' key"))
+	}
+
+	node, ok = config_map["paths"]
+	if !ok {
+		panic(fmt.Errorf("'paths' list must be defined in config"))
+	}
+
+	var paths []string
+	paths_scan := make(map[string]yaml.Map)
+	config_list, ok = node.(yaml.List)
+	if !ok {
+		path, ok := node.(yaml.Scalar)
+		if !ok {
+			panic(fmt.Errorf("'paths' must be a list or (worst-case) scalar"))
+		}
+		paths = append(paths, string(path))
+	} else {
+		for _, node := range config_list {
+			path, ok := node.(yaml.Scalar)
+			if !ok {
+				path_map, ok_map := node.(yaml.Map)
+				if ok_map {
+					path, ok = path_map["path"].(yaml.Scalar)
+				}
+				if ok {
+					paths_scan[string(path)] = path_map
+				}
+			}
+			if !ok {
+				log.Warnf("Skipped invalid path specification: %v", node)
+			} else {
+				paths = append(paths, string(path))
+			}
+		}
+	}
+	for n, root := range paths {
+		path, err := path_t(root).ExpandUser()
+		if err == nil {
+			paths[n] = string(path)
+			if path_map, ok := paths_scan[root]; ok {
+				delete(paths_scan, root)
+				paths_scan[string(path)] = path_map
+			}
+		}
+	}
+	config.paths = paths
+
+	// Traversal options
+	tgrs.ContentBytes = 8192
+	config.scan = scan_opts{cachedir_tag: true}
+	config.markers = []string{marker_file_default}
+	node, ok = config_map["scan"]
+	if ok {
+		scan_map, ok := node.(yaml.Map)
+		if !ok {
+			panic(fmt.Errorf("'scan' section must be a map"))
+		}
+		config.scan.parse(scan_map, "scan")
+		node, ok = scan_map["content_bytes"]
+		if ok {
+			val, ok := node.(yaml.Scalar)
+			n, err := strconv.Atoi(string(val))
+			if !ok || err != nil || n <= 0 {
+				panic(fmt.Errorf("'scan.content_bytes' must be a positive integer: %v", node))
+			}
+			tgrs.ContentBytes = n
+		}
+		node, ok = scan_map["markers"]
+		if ok {
+			config_list, ok = node.(yaml.List)
+			if !ok {
+				panic(fmt.Errorf("'scan.markers' must be a list of file names"))
+			}
+			for _, node := range config_list {
+				name, ok := node.(yaml.Scalar)
+				if !ok || len(name) == 0 || strings.Contains(string(name), "/") {
+					panic(fmt.Errorf("'scan.markers' must be a list of file names: %v", node))
+				}
+				config.markers = append(config.markers, string(name))
+			}
+		}
+	}
+	config.paths_scan = make(map[string]scan_opts, len(paths_scan))
+	for root, path_map := range paths_scan {
+		opts := config.scan
+		opts.parse(path_map, "paths")
+		config.paths_scan[root] = opts
+	}
+
+	// Init output backend
+	backend_name, backend_conf := "tmsu", yaml.Map{}
+	node, ok = config_map["output"]
+	if ok {
+		backend_conf, ok = node.(yaml.Map)
+		if !ok {
+			panic(fmt.Errorf("'output' section must be a map"))
+		}
+		node, ok = backend_conf["backend"]
+		if ok {
+			name, ok := node.(yaml.Scalar)
+			if !ok {
+				panic(fmt.Errorf("'output.backend' must be a string: %v", node))
+			}
+			backend_name = string(name)
+		}
+	}
+
+	// Path to index file is also used by "files" command, regardless of backend
+	index_path := path_t(index.PathDefault)
+	node, ok = backend_conf["index_path"]
+	if ok {
+		path, ok := node.(yaml.Scalar)
+		if !ok {
+			panic(fmt.Errorf("'output.index_path' must be a string: %v", node))
+		}
+		index_path = path_t(path)
+	}
+	index_path, err = index_path.ExpandUser()
+	if err != nil {
+		panic(fmt.Errorf("Failed to expand index path (%v): %v", index_path, err))
+	}
+	backend_conf["index_path"] = yaml.Scalar(index_path)
+	config.index_path = string(index_path)
+
+	if len(output_format) > 0 {
+		switch output_format {
+			case "jsonl", "tsv", "tree":
+				backend_name = output_format
+			default:
+				panic(fmt.Errorf("Unknown --output-format value: %v", output_format))
+		}
+	}
+	if dry_run && !diff {
+		backend_name = "none"
+	}
+	config.backend_name = backend_name
+	config.backend, err = backends.Get(backend_name, backend_conf, log)
+	if err != nil {
+		panic(fmt.Errorf("Failed to init output backend (%v): %v", backend_name, err))
+	}
+
+	// State cache, only used if tags are stored by the backend
+	node, ok = config_map["cache"]
+	if ok && !dry_run && !diff && len(output_format) == 0 {
+		cache_path, ok := yaml.Scalar(""), false
+		cache_map, ok := node.(yaml.Map)
+		if ok {
+			cache_path, ok = cache_map["path"].(yaml.Scalar)
+		}
+		if !ok {
+			panic(fmt.Errorf("'cache' section must be a map with 'path' string: %v", node))
+		}
+		path, err := path_t(cache_path).ExpandUser()
+		if err != nil {
+			panic(fmt.Errorf("Failed to expand cache path (%v): %v", cache_path, err))
+		}
+		// Any changes to configuration or mode of operation invalidate the cache
+		config_bytes, err := os.ReadFile(config_path)
+		if err != nil {
+			panic(err)
+		}
+		hash := fnv.New64a()
+		hash.Write(config_bytes)
+		config.cache_path = string(path)
+		config.cache_key = fmt.Sprintf("%x %v %v", hash.Sum64(), backend_name, sync_tags)
+	}
+
+	// Init taggers
+	node, ok = config_map["taggers"]
+	if ok {
+		config_map, ok = node.(yaml.Map)
+	}
+	if !ok {
+		log.Warn("No 'taggers' defined, nothing to do")
+		return config, log_init, nil
+	}
+
+	config.taggers, config.namespaces = taggers_load(config_map, log)
+
+	if sync_tags {
+		syncer, ok := config.backend.(backends.Syncer)
+		if !ok {
+			panic(fmt.Errorf("Output backend (%v) does not support --sync mode", backend_name))
+		}
+		err = syncer.Sync(config.namespaces)
+		if err != nil {
+			panic(fmt.Errorf("Failed to enable --sync mode for output backend (%v): %v", backend_name, err))
+		}
+	}
+
+	if diff {
+		differ, ok := config.backend.(backends.Differ)
+		if !ok {
+			panic(fmt.Errorf("Output backend (%v) does not support --diff mode", backend_name))
+		}
+		err = differ.Diff(os.Stdout)
+		if err != nil {
+			panic(fmt.Errorf("Failed to enable --diff mode for output backend (%v): %v", backend_name, err))
+		}
+	}
+
+	return config, log_init, nil
+}
+
+// Return traversal options for one of the configured paths.
+func (config *config_t) root_opts(root string) scan_opts {
+	opts, ok := config.paths_scan[root]
+	if !ok {
+		opts = config.scan
+	}
+	return opts
+}
+
+// Return configured path that contains specified one (longest one, if nested),
+//  or an empty string if there's no such path.
+// Returned path_rel is the specified path, relative to the same dir as configured one is.
+func (config *config_t) path_root(path string) (root, path_rel string) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return
+	}
+	root_abs := ""
+	for _, root_conf := range config.paths {
+		root_conf_abs, err := filepath.Abs(root_conf)
+		if err != nil {
+			continue
+		}
+		if (path == root_conf_abs || strings.HasPrefix(path, root_conf_abs + string(filepath.Separator))) &&
+				len(root_conf_abs) > len(root_abs) {
+			root, root_abs = root_conf, root_conf_abs
+		}
+	}
+	if len(root) > 0 {
+		path_rel = filepath.Join(root, path[len(root_abs):])
+	}
+	return
+}
+
+
+// Init taggers from a map of namespace to a tagger (or list of these) specs,
+//  returning taggers for each listed namespace (can be empty) and namespace names.
+// Namespace names don't include one for "_none" key.
+func taggers_load(config_map yaml.Map, log *logging.Logger) (taggers map[string][]*tgrs.Tagger, namespaces []string) {
+	taggers = make(map[string][]*tgrs.Tagger)
+
+	init_tagger := func(ns, name string, config *yaml.Node) {
+		tagger, err := tgrs.Get(name, config, log)
+		if err != nil {
+			log.Warnf("Failed to init tagger %v (ns: %v): %v", ns, name, err)
+		} else {
+			taggers[ns] = append(taggers[ns], tagger)
+		}
+	}
+
+	namespaces = []string{}
+
+	for ns, node := range config_map {
+		if ns == "_none" {
+			ns = ""
+		}
+		if strings.HasPrefix(ns, "_") {
+			log.Warnf("Ignoring namespace name, starting with underscore: %v", ns)
+			continue
+		}
+		if ns != "" {
+			namespaces = append(namespaces, ns)
+		}
+		taggers[ns] = nil
+
+		config_list, ok := node.(yaml.List)
+		if !ok {
+			// It's also ok to have "ns: tagger" spec, if there's just one for ns
+			tagger, ok := node.(yaml.Scalar)
+			if node == nil || (ok && (tagger == "" || tagger == "[]")) {
+				// Empty value or "[]" is an empty list of taggers
+				continue
+			}
+			if !ok {
+				log.Warnf("Invalid tagger(-list) specification (ns: %v): %v", ns, node)
+				continue
+			}
+			init_tagger(ns, string(tagger), nil)
+			continue
+		}
+
+		for _, node = range config_list {
+			tagger_map, ok := node.(yaml.Map)
+			if !ok {
+				tagger, ok := node.(yaml.Scalar)
+				if !ok {
+					log.Warnf("Invalid tagger specification - "+
+						"must be map or string (ns: %v): %v", ns, node)
+					continue
+				}
+				init_tagger(ns, string(tagger), nil)
+				continue
+			}
+			if len(tagger_map) != 1 {
+				log.Warnf("Invalid tagger specification - "+
+					"map must contain only one element (ns: %v): %v", ns, tagger_map)
+				continue
+			}
+			for tagger, node := range tagger_map {
+				init_tagger(ns, tagger, &node)
+				continue
+			}
+		}
+	}
+	return
+}
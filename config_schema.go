@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"flag"
+	"os"
+	"sort"
+	"strings"
+	"path/filepath"
+	"github.com/kylelemons/go-gypsy/yaml"
+	tgrs "codetag/taggers"
+	"codetag/backends"
+	"codetag/schema"
+)
+
+
+// Schema for the whole configuration file, with filter rules relative to its dir.
+func config_schema(config_dir string) schema.Schema {
+	scan_keys := func(keys map[string]schema.Schema) map[string]schema.Schema {
+		for _, key := range []string{"vcs_ignore", "git_index",
+				"cachedir_tag", "follow_symlinks", "symlink_tag", "xdev"} {
+			keys[key] = schema.Bool
+		}
+		return keys
+	}
+
+	filter_rule := schema.Scalar{Kind: "a filter rule", Value: func(rule string) error {
+		_, err := filter_parse(rule, "", config_dir)
+		return err
+	}}
+	marker_name := schema.Scalar{Kind: "a file name", Value: func(name string) error {
+		if len(name) == 0 || strings.Contains(name, "/") {
+			return fmt.Errorf("must be a file name: %q", name)
+		}
+		return nil
+	}}
+
+	tagger_name := schema.Scalar{Kind: "a tagger name", Value: func(name string) error {
+		conf_schema, ok := tgrs.Schema(name)
+		if !ok {
+			return fmt.Errorf("unknown tagger type: %v", name)
+		}
+		if len(conf_schema.Required) > 0 {
+			return fmt.Errorf("%v requires %v", name, strings.Join(conf_schema.Required, ", "))
+		}
+		return nil
+	}}
+	// Single-key map of tagger name to its configuration
+	tagger_map := schema.Func(func(node yaml.Node, path string) []error {
+		conf := node.(yaml.Map)
+		if len(conf) != 1 {
+			return []error{schema.Errorf(path, "map must contain only one element - tagger name")}
+		}
+		for name, node := range conf {
+			conf_schema, ok := tgrs.Schema(name)
+			if !ok {
+				return []error{schema.Errorf(schema.Key(path, name), "unknown tagger type")}
+			}
+			return conf_schema.Check(node, schema.Key(path, name))
+		}
+		return nil
+	})
+	tagger_list := schema.Either{Null: true,
+		Scalar: schema.Scalar{Kind: "a tagger name", Value: func(name string) error {
+			if name == "" || name == "[]" {
+				return nil
+			}
+			return tagger_name.Value(name)
+		}},
+		List: schema.List{Item: schema.Either{Scalar: tagger_name, Map: tagger_map}}}
+	taggers := schema.Func(func(node yaml.Node, path string) (errs []error) {
+		conf, ok := node.(yaml.Map)
+		if !ok {
+			return []error{schema.Errorf(path, "must be a map of namespaces to taggers")}
+		}
+		namespaces := make([]string, 0, len(conf))
+		for ns, _ := range conf {
+			namespaces = append(namespaces, ns)
+		}
+		sort.Strings(namespaces)
+		for _, ns := range namespaces {
+			if strings.HasPrefix(ns, "_") && ns != "_none" {
+				errs = append(errs, schema.Errorf(schema.Key(path, ns),
+					"namespace names can't start with underscore, except for _none"))
+				continue
+			}
+			errs = append(errs, tagger_list.Check(conf[ns], schema.Key(path, ns))...)
+		}
+		return
+	})
+
+	return schema.Map{Required: []string{"paths"}, Keys: map[string]schema.Schema{
+		"paths": schema.Either{
+			Scalar: schema.String,
+			List: schema.List{Item: schema.Either{
+				Scalar: schema.String,
+				Map: schema.Map{Required: []string{"path"},
+					Keys: scan_keys(map[string]schema.Schema{"path": schema.String})} }} },
+		"filter": schema.List{Item: filter_rule},
+		"scan": schema.Map{Keys: scan_keys(map[string]schema.Schema{
+			"content_bytes": schema.PositiveInt,
+			"markers": schema.List{Item: marker_name} })},
+		"taggers": taggers,
+		"output": schema.Map{Keys: map[string]schema.Schema{
+			"backend": schema.Enum(backends.Names()...),
+			"index_path": schema.String,
+			"batch_files": schema.PositiveInt,
+			"batch_bytes": schema.PositiveInt }},
+		"cache": schema.Map{Required: []string{"path"},
+			Keys: map[string]schema.Schema{"path": schema.String}},
+		"logging": schema.Map{Required: []string{"loggers"},
+			Keys: map[string]schema.Schema{"loggers": schema.Map{Values: schema.String}},
+			Values: schema.Map{Values: schema.String}},
+	}}
+}
+
+// Validate configuration file, returning all issues found in it.
+func config_check(config_path string) []error {
+	config_yaml, err := yaml.ReadFile(config_path)
+	if err != nil {
+		return []error{err}
+	}
+	return schema.Check(config_yaml, config_schema(filepath.Dir(config_path)))
+}
+
+
+// Only report that configuration file is valid, as it was already checked on load.
+func cmd_check_config(config *config_t, args []string) int {
+	flags := flag.NewFlagSet("check-config", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %v [ <options> ] check-config\n\n"+
+			"Validate configuration file against schema of all its sections and tagger options,\n"+
+			"reporting every issue with its key path, and exit with non-zero code if there are any.\n"+
+			"Same check is done before running any other command with --strict option.\n", os.Args[0])
+	}
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return 1
+	}
+	fmt.Fprintf(os.Stdout, "Configuration file is valid: %v\n", config.path)
+	return 0
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"os"
+	"path/filepath"
+	"github.com/kylelemons/go-gypsy/yaml"
+	tgrs "codetag/taggers"
+)
+
+
+// Name of per-directory configuration files.
+const dir_config_name = ".codetag.yaml"
+
+// Paths (relative to dir) that affect tags of everything within the dir.
+// Same as taggers.CtxInputs, but with per-directory configuration file.
+var ctx_inputs = append(append([]string{}, tgrs.CtxInputs...), dir_config_name)
+
+// Settings from per-directory configuration file, applied to everything within its dir.
+type dir_config struct {
+	// Static tags, same as returned by static taggers (see ctx_static_tags)
+	tags []string
+	filters path_filters
+	// Taggers for namespaces that are overridden in this dir, can be empty
+	taggers map[string][]*tgrs.Tagger
+}
+
+// Read per-directory configuration file, if there is one in the dir.
+// Returns nil without error if there's no such file.
+func dir_config_load(entry *tgrs.Entry, config *config_t) (conf *dir_config, err error) {
+	mode, ok := entry.Contains(dir_config_name)
+	if !ok || mode & os.ModeType != 0 {
+		return
+	}
+	path, log := filepath.Join(entry.Path, dir_config_name), config.log
+	// Main configuration file can be ~/.codetag.yaml, which is not a per-directory one
+	if path_abs, err := filepath.Abs(path); err == nil {
+		if config_abs, err := filepath.Abs(config.path); err == nil && path_abs == config_abs {
+			return nil, nil
+		}
+	}
+
+	defer func() {
+		// Same as with main configuration file, panics are used for any issues
+		if err_panic := recover(); err_panic != nil {
+			conf, err = nil, fmt.Errorf("Failed to process configuration file (%q): %v", path, err_panic)
+		}
+	}()
+
+	config_yaml, err := yaml.ReadFile(path)
+	if err != nil {
+		panic(err)
+	}
+	conf = &dir_config{}
+	if config_yaml.Root == nil {
+		return
+	}
+	config_map, ok := config_yaml.Root.(yaml.Map)
+	if !ok {
+		panic(fmt.Errorf("must be a map"))
+	}
+
+	for key, node := range config_map {
+		switch key {
+			case "tags":
+				tag_list, ok := node.(yaml.List)
+				if !ok {
+					tag_list = yaml.List{node}
+				}
+				for _, node := range tag_list {
+					tag, ok := node.(yaml.Scalar)
+					if !ok || len(tag) == 0 {
+						panic(fmt.Errorf("'tags' must be a list of ns:value strings: %v", node))
+					}
+					conf.tags = append(conf.tags, strings.Trim(string(tag), "'"))
+				}
+			case "filter":
+				rule_list, ok := node.(yaml.List)
+				if !ok {
+					panic(fmt.Errorf("'filter' must be a list of rules"))
+				}
+				for _, node := range rule_list {
+					rule, ok := node.(yaml.Scalar)
+					if !ok {
+						panic(fmt.Errorf("Filter rule must be a string: %v", node))
+					}
+					rule_str := strings.Trim(string(rule), "'")
+					rule_filters, err := filter_parse(rule_str, entry.Path, entry.Path)
+					if err != nil {
+						panic(fmt.Errorf("Failed to parse filter rule (%v): %v", rule_str, err))
+					}
+					conf.filters = append(conf.filters, rule_filters...)
+				}
+			case "taggers":
+				taggers_map, ok := node.(yaml.Map)
+				if !ok {
+					panic(fmt.Errorf("'taggers' must be a map"))
+				}
+				conf.taggers, _ = taggers_load(taggers_map, log)
+			default:
+				log.Warnf("Unknown key in configuration file (%q): %v", path, key)
+		}
+	}
+	return
+}
+
+// Override taggers in the context of the dir.
+func (conf *dir_config) apply(ctx ctx_t) {
+	for ns, tagger_list := range conf.taggers {
+		ctx_ns(ctx, ns).Set("taggers", tagger_list)
+	}
+}
+
+// Add static tags to the context of the dir, after all taggers were run for it.
+// Returns tags that were added for each namespace.
+func (conf *dir_config) apply_tags(ctx ctx_t) map[string][]string {
+	return ctx_static_tags(ctx, "", conf.tags)
+}
+
+// Add static tags (e.g. from ".tags" or ".codetag.yaml" files) to the context of the dir.
+// Tags are "ns:value" strings, or values for ns_default namespace, if there's no ":" in these.
+// Ones starting with "!" remove inherited tags in all namespaces that are equal to or prefixed
+//  (as in namespace) by the rest of the string, e.g. "!client" removes "client:acme",
+//  while "!" on its own removes all inherited tags.
+// Returns tags that were added for each namespace.
+func ctx_static_tags(ctx ctx_t, ns_default string, tags []string) (added map[string][]string) {
+	added = make(map[string][]string)
+	resets := []string{}
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, "!") {
+			resets = append(resets, tag[1:])
+			continue
+		}
+		ns, value, ok := strings.Cut(tag, ":")
+		if !ok {
+			ns, value = ns_default, tag
+		}
+		added[ns] = append(added[ns], value)
+	}
+
+	for ns, ctx_ns := range ctx {
+		if len(resets) == 0 || ctx_ns.Parent() == nil {
+			continue
+		}
+		inherited, tags_set, reset := ctx_ns.Parent().Tags(), make(tgrs.CtxTagset), false
+		for tag, _ := range ctx_ns.Tags() {
+			tag_ns := tag
+			if len(ns) > 0 {
+				tag_ns = ns + ":" + tag
+			}
+			keep := true
+			for _, prefix := range resets {
+				if inherited[tag] && (len(prefix) == 0 ||
+						tag_ns == prefix || strings.HasPrefix(tag_ns, prefix + ":")) {
+					keep = false
+					break
+				}
+			}
+			if keep {
+				tags_set[tag] = true
+			} else {
+				reset = true
+			}
+		}
+		if reset {
+			ctx_ns.Set("tags", tags_set)
+		}
+	}
+
+	for ns, values := range added {
+		ctx_ns(ctx, ns).AddTags(values)
+	}
+	return
+}
+
+// Return context for the namespace, creating one if it's not used by configured taggers.
+func ctx_ns(ctx ctx_t, ns string) *tgrs.Ctx {
+	ctx_ns, ok := ctx[ns]
+	if !ok {
+		ctx_ns = tgrs.NewCtx(nil)
+		ctx[ns] = ctx_ns
+	}
+	return ctx_ns
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"flag"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"path/filepath"
+	"codetag/backends"
+	tgrs "codetag/taggers"
+)
+
+
+// Record of how path and its ancestor dirs were processed, for "explain" command.
+// Methods are no-op for nil explainer, which is used for normal processing.
+// Not safe for concurrent use, so only one path should be processed with it at a time.
+type explainer struct {
+	path string
+	// Filter verdicts and reasons for skipping paths, in order
+	notes []explain_note
+	// Tags produced for each path, and ones that fallback taggers were skipped due to
+	tags, skips []explain_tags
+	// Tags for the path, nil if it wasn't processed
+	result []string
+}
+
+type explain_note struct {
+	path, note string
+}
+
+type explain_tags struct {
+	path, ns string
+	// Tagger or some other source of tags, e.g. per-directory configuration file
+	source string
+	tags []string
+}
+
+func (ex *explainer) note(path, format string, args ...interface{}) {
+	if ex == nil {
+		return
+	}
+	ex.notes = append(ex.notes, explain_note{path, fmt.Sprintf(format, args...)})
+}
+
+func (ex *explainer) tagged(path, ns, source string, tags []string) {
+	if ex == nil {
+		return
+	}
+	ex.tags = append(ex.tags, explain_tags{path, ns, source, tags})
+}
+
+func (ex *explainer) skipped(path, ns, source string, tags tgrs.CtxTagset) {
+	if ex == nil {
+		return
+	}
+	skip := explain_tags{path: path, ns: ns, source: source}
+	for tag, _ := range tags {
+		skip.tags = append(skip.tags, tag)
+	}
+	sort.Strings(skip.tags)
+	ex.skips = append(ex.skips, skip)
+}
+
+// Find latest source of the namespaced tag (as in ctx_tags), if any.
+func (ex *explainer) source(tag string) (src explain_tags, ok bool) {
+	for n := len(ex.tags) - 1; n >= 0; n-- {
+		src = ex.tags[n]
+		for _, value := range src.tags {
+			if len(src.ns) > 0 {
+				value = src.ns + ":" + value
+			}
+			if value == tag {
+				return src, true
+			}
+		}
+	}
+	return
+}
+
+// Print human-readable report on everything recorded for the path.
+func (ex *explainer) report(out io.Writer, root string) {
+	ns_name := func(ns string) string {
+		if len(ns) == 0 {
+			return "_none"
+		}
+		return ns
+	}
+	fmt.Fprintf(out, "Path: %v\n", ex.path)
+	if len(root) > 0 {
+		fmt.Fprintf(out, "Configured path: %v\n", root)
+	} else {
+		fmt.Fprintln(out, "Configured path: none, processed on its own")
+	}
+
+	fmt.Fprintln(out, "\nFilters:")
+	for _, note := range ex.notes {
+		fmt.Fprintf(out, "  %v - %v\n", note.path, note.note)
+	}
+
+	fmt.Fprintln(out, "\nTags:")
+	if ex.result == nil {
+		fmt.Fprintln(out, "  none, path was not tagged")
+	} else if len(ex.result) == 0 {
+		fmt.Fprintln(out, "  none")
+	}
+	for _, tag := range ex.result {
+		src, ok := ex.source(tag)
+		if !ok {
+			fmt.Fprintf(out, "  %v - unknown source\n", tag)
+			continue
+		}
+		line := fmt.Sprintf("  %v - %v (ns: %v)", tag, src.source, ns_name(src.ns))
+		if strings.HasPrefix(ex.path, src.path + string(filepath.Separator)) {
+			line += ", inherited from: " + src.path
+		}
+		fmt.Fprintln(out, line)
+	}
+
+	if len(ex.skips) > 0 {
+		fmt.Fprintln(out, "\nSkipped fallback taggers:")
+	}
+	for _, skip := range ex.skips {
+		fmt.Fprintf(out, "  %v (ns: %v) for %v - namespace already has tags: %v\n",
+			skip.source, ns_name(skip.ns), skip.path, strings.Join(skip.tags, " "))
+	}
+}
+
+
+// Show how paths would be processed, without tagging these.
+func cmd_explain(config *config_t, args []string) int {
+	flags := flag.NewFlagSet("explain", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %v [ <options> ] explain <path>...\n\n"+
+			"Show how each path would be processed, without tagging anything:\n"+
+			" - which filter rule matched it and each of its parent dirs (if any);\n"+
+			" - which tagger (and namespace) produced each tag for it;\n"+
+			" - whether tag was inherited from one of its parent dirs;\n"+
+			" - which fallback taggers were skipped and why.\n", os.Args[0])
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 1
+	}
+
+	// Tags are only reported, so state cache and output backend are not used
+	log := config.log
+	backend, err := backends.Get("none", nil, log)
+	if err != nil {
+		log.Fatal(err)
+		return 1
+	}
+	config.cache_path, config.backend_name, config.backend = "", "none", backend
+	w, err := walker_new(config)
+	if err != nil {
+		log.Fatal(err)
+		return 1
+	}
+	defer w.close()
+
+	status := 0
+	for n, path := range flags.Args() {
+		path, err := filepath.Abs(path)
+		if err == nil {
+			_, err = os.Lstat(path)
+		}
+		if err != nil {
+			log.Errorf("Failed to process path (%s): %v", path, err)
+			status = 1
+			continue
+		}
+		root, path_rel := config.path_root(path)
+		w.explain = &explainer{path: path_rel}
+		w.seen = make(map[file_id]string)
+		if len(root) == 0 {
+			w.explain.path = path
+			w.walk_paths(path, []string{path})
+		} else {
+			w.walk_paths(root, []string{path_rel})
+		}
+		w.flush()
+		if n > 0 {
+			fmt.Println()
+		}
+		w.explain.report(os.Stdout, root)
+		w.explain = nil
+	}
+	return status
+}
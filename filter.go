@@ -0,0 +1,434 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"os"
+	"bufio"
+	"io"
+	"strconv"
+	"time"
+	"path/filepath"
+	re "regexp"
+	tgrs "codetag/taggers"
+	"codetag/ignore"
+)
+
+
+// Name of per-directory filter files, which are always merged in,
+//  unless there's explicit "dir-merge" rule for these in configuration file.
+const filter_file_default = ".codetag-filter"
+
+// Name of the marker file, presence of which excludes directory from processing,
+//  unless it contains filter rules, which are then applied to everything in that dir.
+const marker_file_default = ".codetag-ignore"
+
+// Signature at the start of CACHEDIR.TAG files, see https://bford.info/cachedir/
+const cachedir_tag_signature = "Signature: 8a477f597d28d172789f06886806bc55"
+
+// Parsed filter rule, matched against path relative to its base dir (or root path,
+//  if not set), starting with "/" and with trailing slash for directories in regexps.
+type path_filter struct {
+	// Rule as it was specified
+	rule string
+	verdict bool
+	// Can be nil, if rule only has predicates
+	pattern *re.Regexp
+	regexp, dir_only bool
+	// Predicates on path properties, which must all be true for rule to match
+	preds []path_pred
+	base string
+	// Name of per-directory files for "dir-merge" rules, and rules merged from these
+	merge string
+	merged path_filters
+}
+type path_filters []path_filter
+
+// Predicate on path properties other than its name, with depth relative to the root.
+type path_pred func(entry *tgrs.Entry, depth int) bool
+
+// Parse rsync-like filter rule, which can be one of:
+//  "+ pattern", "- pattern" (or "include pattern", "exclude pattern")
+//  ". file" (or "merge file") - rules from specified file, inserted in its place,
+//  ": name" (or "dir-merge name") - rules from files with that name in each directory,
+//    applied to paths within that directory, with nested ones taking priority.
+// Patterns are rsync-like globs, or regexps, if prefixed by "re:", and can be
+//  preceded by space-separated predicates (see filter_pred), or only have these.
+// Legacy "+regexp" and "-regexp" rules (without space) are also supported.
+// Relative merge-file paths are resolved against dir, base is set for parsed rules.
+func filter_parse(rule, base, dir string) (filters path_filters, err error) {
+	kind, arg := "", ""
+	if len(rule) > 1 && strings.ContainsAny(rule[:1], "+-") && !strings.ContainsAny(rule[1:2], " _") {
+		kind, arg = rule[:1], "re:" + rule[1:]
+	} else if len(rule) > 1 && strings.ContainsAny(rule[:1], "+-.:") && rule[1] == '_' {
+		kind, arg = rule[:1], rule[2:]
+	} else {
+		kind, arg, _ = strings.Cut(rule, " ")
+		arg = strings.TrimLeft(arg, " ")
+	}
+	switch kind {
+		case "include":
+			kind = "+"
+		case "exclude":
+			kind = "-"
+		case "merge":
+			kind = "."
+		case "dir-merge":
+			kind = ":"
+	}
+	if len(arg) == 0 {
+		return nil, fmt.Errorf("missing pattern or file name")
+	}
+
+	filter := path_filter{rule: rule, base: base}
+	switch kind {
+		case "+", "-":
+			filter.verdict = kind == "+"
+			for len(arg) > 0 {
+				term, rest, _ := strings.Cut(arg, " ")
+				pred, ok, err := filter_pred(term)
+				if err != nil {
+					return nil, err
+				}
+				if !ok {
+					break
+				}
+				filter.preds, arg = append(filter.preds, pred), strings.TrimLeft(rest, " ")
+			}
+			if len(arg) == 0 {
+				break
+			}
+			if strings.HasPrefix(arg, "re:") {
+				filter.pattern, err = re.Compile(arg[3:])
+				filter.regexp = true
+			} else {
+				filter.pattern, filter.dir_only, err = filter_glob(arg)
+			}
+			if err != nil {
+				return nil, err
+			}
+		case ".":
+			path, err := path_t(arg).ExpandUser()
+			if err != nil {
+				return nil, err
+			}
+			if !filepath.IsAbs(string(path)) {
+				path = path_t(filepath.Join(dir, string(path)))
+			}
+			return filter_load(string(path), base)
+		case ":":
+			if len(base) > 0 {
+				return nil, fmt.Errorf("dir-merge rules can't be used in per-directory filter files")
+			}
+			if strings.Contains(arg, "/") {
+				return nil, fmt.Errorf("dir-merge file name can't contain slashes: %v", arg)
+			}
+			filter.merge = arg
+		default:
+			return nil, fmt.Errorf("unknown rule type: %v", kind)
+	}
+	return path_filters{filter}, nil
+}
+
+// Compile rsync-like glob pattern to regexp.
+// Patterns starting with "/" are anchored to the base dir, others match
+//  at the end of the path, patterns with trailing slash only match directories,
+//  and "dir/***" matches dir itself along with everything in it.
+func filter_glob(pattern string) (regexp *re.Regexp, dir_only bool, err error) {
+	prefix, suffix := "/", ""
+	if strings.HasSuffix(pattern, "/") {
+		pattern, dir_only = strings.TrimRight(pattern, "/"), true
+	}
+	if strings.HasPrefix(pattern, "/") {
+		pattern, prefix = pattern[1:], "^/"
+	}
+	if strings.HasSuffix(pattern, "/***") {
+		pattern, suffix = pattern[:len(pattern)-4], "(/.*)?"
+	}
+	if len(pattern) == 0 {
+		return nil, false, fmt.Errorf("empty pattern")
+	}
+	regexp, err = re.Compile(prefix + ignore.GlobRegexp(pattern) + suffix + "$")
+	return
+}
+
+var (
+	filter_size_units = map[string]int64{"": 1, "b": 1,
+		"k": 1<<10, "m": 1<<20, "g": 1<<30, "t": 1<<40,
+		"kb": 1<<10, "mb": 1<<20, "gb": 1<<30, "tb": 1<<40}
+	filter_age_units = map[string]time.Duration{"": time.Second, "s": time.Second,
+		"m": time.Minute, "h": time.Hour, "d": 24 * time.Hour,
+		"w": 7 * 24 * time.Hour, "y": 365 * 24 * time.Hour}
+	filter_type_chars = map[byte]os.FileMode{'f': 0, 'd': os.ModeDir, 'l': os.ModeSymlink,
+		'p': os.ModeNamedPipe, 's': os.ModeSocket, 'c': os.ModeDevice | os.ModeCharDevice, 'b': os.ModeDevice}
+	filter_cmp_value = re.MustCompile(`^(<=|>=|<|>|=)?(\d+)([a-zA-Z]{0,2})$`)
+)
+
+// Parse predicate on path properties, returning ok=false if term is not a predicate.
+// Supported predicates are:
+//  "size:>10M" - file size, with optional B or K/M/G/T (binary) suffix, e.g. "100b" or "10MB".
+//  "depth:>3" - depth of path relative to root, where root itself is 0.
+//  "age:>2y" - time since last modification, with s/m/h/d/w/y units (default - seconds).
+//  "type:fl" - path type (as in find -type): f, d, l, p, s, c or b.
+//  "mode:/111", "mode:-644", "mode:644" - permission bits (as in find -perm):
+//    any of specified bits set, all of these set or exact match.
+// Comparisons for numeric predicates can be one of "<", ">", "<=", ">=" or "=" (default).
+func filter_pred(term string) (pred path_pred, ok bool, err error) {
+	name, spec, ok := strings.Cut(term, ":")
+	if !ok {
+		return
+	}
+	cmp := func(units map[string]int64) (func(int64) bool, error) {
+		m := filter_cmp_value.FindStringSubmatch(spec)
+		unit, ok := int64(0), false
+		if m != nil {
+			unit, ok = units[strings.ToLower(m[3])]
+		}
+		if !ok {
+			return nil, fmt.Errorf("invalid %v predicate value: %v", name, spec)
+		}
+		n, err := strconv.ParseInt(m[2], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		n *= unit
+		switch m[1] {
+			case "<":
+				return func(v int64) bool { return v < n }, nil
+			case ">":
+				return func(v int64) bool { return v > n }, nil
+			case "<=":
+				return func(v int64) bool { return v <= n }, nil
+			case ">=":
+				return func(v int64) bool { return v >= n }, nil
+		}
+		return func(v int64) bool { return v == n }, nil
+	}
+	info := func(entry *tgrs.Entry) os.FileInfo {
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		return info
+	}
+
+	switch name {
+		case "size":
+			check, err := cmp(filter_size_units)
+			if err != nil {
+				return nil, true, err
+			}
+			pred = func(entry *tgrs.Entry, depth int) bool {
+				info := info(entry)
+				return info != nil && check(info.Size())
+			}
+		case "depth":
+			check, err := cmp(map[string]int64{"": 1})
+			if err != nil {
+				return nil, true, err
+			}
+			pred = func(entry *tgrs.Entry, depth int) bool { return check(int64(depth)) }
+		case "age":
+			units := make(map[string]int64, len(filter_age_units))
+			for k, v := range filter_age_units {
+				units[k] = int64(v)
+			}
+			check, err := cmp(units)
+			if err != nil {
+				return nil, true, err
+			}
+			pred = func(entry *tgrs.Entry, depth int) bool {
+				info := info(entry)
+				return info != nil && check(int64(time.Since(info.ModTime())))
+			}
+		case "type":
+			types := []os.FileMode{}
+			for n := 0; n < len(spec); n++ {
+				mode, ok := filter_type_chars[spec[n]]
+				if !ok {
+					return nil, true, fmt.Errorf("invalid type predicate value: %v", spec)
+				}
+				types = append(types, mode)
+			}
+			if len(types) == 0 {
+				return nil, true, fmt.Errorf("empty type predicate")
+			}
+			pred = func(entry *tgrs.Entry, depth int) bool {
+				for _, mode := range types {
+					if entry.Mode & (os.ModeType | os.ModeCharDevice) == mode {
+						return true
+					}
+				}
+				return false
+			}
+		case "mode":
+			op := ""
+			if strings.HasPrefix(spec, "/") || strings.HasPrefix(spec, "-") {
+				op, spec = spec[:1], spec[1:]
+			}
+			bits, err := strconv.ParseUint(spec, 8, 32)
+			if err != nil || bits & ^uint64(os.ModePerm) != 0 {
+				return nil, true, fmt.Errorf("invalid mode predicate value: %v", spec)
+			}
+			perm := os.FileMode(bits)
+			pred = func(entry *tgrs.Entry, depth int) bool {
+				info := info(entry)
+				if info == nil {
+					return false
+				}
+				mode := info.Mode().Perm()
+				switch op {
+					case "/":
+						return mode & perm != 0
+					case "-":
+						return mode & perm == perm
+				}
+				return mode == perm
+			}
+		default:
+			return nil, false, nil
+	}
+	return pred, true, nil
+}
+
+// Read filter rules from a file, one per line, skipping empty ones and "#" or ";" comments.
+func filter_load(path, base string) (filters path_filters, err error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer src.Close()
+	lines := bufio.NewScanner(src)
+	for lines.Scan() {
+		line := strings.TrimRight(lines.Text(), "\r")
+		if len(strings.TrimSpace(line)) == 0 || strings.ContainsAny(line[:1], "#;") {
+			continue
+		}
+		rule_filters, err := filter_parse(line, base, filepath.Dir(path))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse filter rule in %v (%q): %v", path, line, err)
+		}
+		filters = append(filters, rule_filters...)
+	}
+	return filters, lines.Err()
+}
+
+// Match path within root against the rules,
+//  returning first matching one, or nil if there's no such rule.
+func (filters path_filters) match(root string, entry *tgrs.Entry) *path_filter {
+	depth := strings.Count(entry.Path[len(root):], string(filepath.Separator))
+	return filters.match_depth(root, entry, depth)
+}
+
+func (filters path_filters) match_depth(root string, entry *tgrs.Entry, depth int) *path_filter {
+	path, is_dir := entry.Path, entry.IsDir()
+	for n := range filters {
+		filter := &filters[n]
+		if len(filter.merge) > 0 {
+			if filter = filter.merged.match_depth(root, entry, depth); filter != nil {
+				return filter
+			}
+			continue
+		}
+		if filter.dir_only && !is_dir {
+			continue
+		}
+		if filter.pattern != nil {
+			base := filter.base
+			if len(base) == 0 {
+				base = root
+			}
+			path_match := path[len(base):]
+			if filter.regexp && is_dir {
+				path_match += "/"
+			}
+			if !filter.pattern.MatchString(path_match) {
+				continue
+			}
+		}
+		matched := true
+		for _, pred := range filter.preds {
+			if matched = pred(entry, depth); !matched {
+				break
+			}
+		}
+		if matched {
+			return filter
+		}
+	}
+	return nil
+}
+
+// Return filters for paths within the directory, with rules from its
+//  per-directory filter files merged in, or same filters if there are none.
+// Returned error is for the first file that failed to be processed, if any.
+func (filters path_filters) dir_merge(entry *tgrs.Entry) (merged path_filters, err error) {
+	merged, copied := filters, false
+	for n, filter := range filters {
+		if len(filter.merge) == 0 {
+			continue
+		}
+		mode, ok := entry.Contains(filter.merge)
+		if !ok || mode & os.ModeType != 0 {
+			continue
+		}
+		rules, err_load := filter_load(filepath.Join(entry.Path, filter.merge), entry.Path)
+		if err_load != nil {
+			if err == nil {
+				err = err_load
+			}
+			continue
+		}
+		if !copied {
+			merged, copied = append(path_filters{}, filters...), true
+		}
+		merged[n].merged = append(rules, filter.merged...)
+	}
+	return
+}
+
+// Check directory for marker files, returning whether it should be skipped,
+//  and filter rules from the default marker file to apply within it, if it has any.
+func markers_check(entry *tgrs.Entry, markers []string, cachedir_tag bool) (prune bool, rules path_filters, err error) {
+	for _, name := range markers {
+		mode, ok := entry.Contains(name)
+		if !ok {
+			continue
+		}
+		if name == marker_file_default && mode & os.ModeType == 0 {
+			rules, err = filter_load(filepath.Join(entry.Path, name), entry.Path)
+			if err == nil && len(rules) > 0 {
+				continue
+			}
+		}
+		return true, nil, err
+	}
+	if !cachedir_tag {
+		return
+	}
+	mode, ok := entry.Contains("CACHEDIR.TAG")
+	if !ok || mode & os.ModeType != 0 {
+		return
+	}
+	src, err := os.Open(filepath.Join(entry.Path, "CACHEDIR.TAG"))
+	if err != nil {
+		return
+	}
+	defer src.Close()
+	signature := make([]byte, len(cachedir_tag_signature))
+	_, err = io.ReadFull(src, signature)
+	if err != nil {
+		return false, rules, nil
+	}
+	return string(signature) == cachedir_tag_signature, rules, nil
+}
+
+// Names of per-directory filter files.
+func (filters path_filters) merge_names() (names []string) {
+	for _, filter := range filters {
+		if len(filter.merge) > 0 {
+			names = append(names, filter.merge)
+		}
+	}
+	return
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	tgrs "codetag/taggers"
+)
+
+
+// Parse list of rules, failing test on any errors.
+func filters_parse(t *testing.T, base, dir string, rules ...string) (filters path_filters) {
+	for _, rule := range rules {
+		rule_filters, err := filter_parse(rule, base, dir)
+		if err != nil {
+			t.Fatalf("failed to parse filter rule %q: %v", rule, err)
+		}
+		filters = append(filters, rule_filters...)
+	}
+	return
+}
+
+// Rule that matched path (with trailing slash for dirs), or empty string if none did.
+func filters_match(filters path_filters, root, path string) string {
+	mode := os.FileMode(0)
+	if strings.HasSuffix(path, "/") {
+		path, mode = strings.TrimRight(path, "/"), os.ModeDir
+	}
+	filter := filters.match(root, tgrs.NewEntry(path, mode, nil, nil))
+	if filter == nil {
+		return ""
+	}
+	return filter.rule
+}
+
+
+func TestFilterParse(t *testing.T) {
+	for _, c := range []struct {
+		rule string
+		verdict, regexp, dir_only bool
+		pattern string
+		preds int
+	}{
+		{"+ *.go", true, false, false, "/[^/]*\\.go$", 0},
+		{"- build/", false, false, true, "/build$", 0},
+		{"include /src/***", true, false, false, "^/src(/.*)?$", 0},
+		{"exclude  *.o", false, false, false, "/[^/]*\\.o$", 0},
+		{"-_*.o", false, false, false, "/[^/]*\\.o$", 0},
+		{"- re:^/node/", false, true, false, "^/node/", 0},
+		// Legacy regexp rules, without space after +/-
+		{"+\\.py$", true, true, false, "\\.py$", 0},
+		{"-^/tmp/", false, true, false, "^/tmp/", 0},
+		// Predicates, with or without pattern
+		{"- size:>1M", false, false, false, "", 1},
+		{"- type:f depth:>2 *.bin", false, false, false, "/[^/]*\\.bin$", 2},
+		{"- size:100b", false, false, false, "", 1},
+		{"- age:>2y mode:/111 x", false, false, false, "/x$", 2},
+		// Not a known predicate name, so it's a pattern
+		{"- c:/x", false, false, false, "/c:/x$", 0},
+	} {
+		filters, err := filter_parse(c.rule, "", "")
+		if err != nil {
+			t.Errorf("rule %q: unexpected error: %v", c.rule, err)
+			continue
+		}
+		if len(filters) != 1 {
+			t.Errorf("rule %q: expected one filter, got %d", c.rule, len(filters))
+			continue
+		}
+		f, pattern := filters[0], ""
+		if f.pattern != nil {
+			pattern = f.pattern.String()
+		}
+		if f.verdict != c.verdict || f.regexp != c.regexp || f.dir_only != c.dir_only ||
+				pattern != c.pattern || len(f.preds) != c.preds {
+			t.Errorf("rule %q: got verdict=%v regexp=%v dir_only=%v pattern=%q preds=%d,"+
+				" expected %v %v %v %q %d", c.rule, f.verdict, f.regexp, f.dir_only, pattern, len(f.preds),
+				c.verdict, c.regexp, c.dir_only, c.pattern, c.preds)
+		}
+	}
+
+	for _, rule := range []string{
+		"", "-", "- ", "+ /", "* x", "bogus x", "+ re:(", "+(",
+		"- size:>1X", "- size:1bb", "- age:2yb", "- depth:1b", "- depth:-1",
+		"- type:q", "- type:", "- mode:999", "- mode:/7777",
+		": a/b", ". /nonexistent/filter-file",
+	} {
+		if _, err := filter_parse(rule, "", ""); err == nil {
+			t.Errorf("rule %q: no error", rule)
+		}
+	}
+	if _, err := filter_parse(": .filter", "/r/d", "/r/d"); err == nil {
+		t.Errorf("no error for dir-merge rule in per-directory filter file")
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	for _, c := range []struct {
+		rules []string
+		path, rule string
+	}{
+		// Unanchored patterns match at the end of path, on dir boundary
+		{[]string{"- *.o"}, "/r/a.o", "- *.o"},
+		{[]string{"- *.o"}, "/r/d/e/a.o", "- *.o"},
+		{[]string{"- foo/bar"}, "/r/foo/bar", "- foo/bar"},
+		{[]string{"- foo/bar"}, "/r/x/foo/bar", "- foo/bar"},
+		{[]string{"- foo/bar"}, "/r/xfoo/bar", ""},
+		{[]string{"- a*b"}, "/r/a/b", ""},
+		{[]string{"- a**b"}, "/r/a/x/b", "- a**b"},
+		// Leading slash anchors to the root
+		{[]string{"- /build"}, "/r/build", "- /build"},
+		{[]string{"- /build"}, "/r/d/build", ""},
+		// Trailing slash only matches dirs
+		{[]string{"- tmp/"}, "/r/tmp/", "- tmp/"},
+		{[]string{"- tmp/"}, "/r/tmp", ""},
+		{[]string{"- /src/***"}, "/r/src/", "- /src/***"},
+		{[]string{"- /src/***"}, "/r/src/a/b.go", "- /src/***"},
+		{[]string{"- /src/***"}, "/r/srcx", ""},
+		{[]string{"- **/gen/*.c"}, "/r/gen/x.c", "- **/gen/*.c"},
+		{[]string{"- **/gen/*.c"}, "/r/a/b/gen/x.c", "- **/gen/*.c"},
+		{[]string{"- **/gen/*.c"}, "/r/a/gen/b/x.c", ""},
+		// Regexps see dirs with trailing slash
+		{[]string{"- re:^/node/$"}, "/r/node/", "- re:^/node/$"},
+		{[]string{"- re:^/node/$"}, "/r/node", ""},
+		{[]string{"-\\.pyc$"}, "/r/a/x.pyc", "-\\.pyc$"},
+		// First matching rule wins
+		{[]string{"+ keep.log", "- *.log"}, "/r/d/keep.log", "+ keep.log"},
+		{[]string{"+ keep.log", "- *.log"}, "/r/d/x.log", "- *.log"},
+		{[]string{"- *.log", "+ keep.log"}, "/r/d/keep.log", "- *.log"},
+		// Depth is relative to the root
+		{[]string{"- depth:>1 *.txt"}, "/r/a.txt", ""},
+		{[]string{"- depth:>1 *.txt"}, "/r/d/a.txt", "- depth:>1 *.txt"},
+		{[]string{"- depth:2"}, "/r/d/", ""},
+		{[]string{"- depth:2"}, "/r/d/e/", "- depth:2"},
+		{[]string{"+ type:d", "- *"}, "/r/d/", "+ type:d"},
+		{[]string{"+ type:d", "- *"}, "/r/f", "- *"},
+	} {
+		filters := filters_parse(t, "", "", c.rules...)
+		if rule := filters_match(filters, "/r", c.path); rule != c.rule {
+			t.Errorf("rules %q, path %q: matched %q, expected %q", c.rules, c.path, rule, c.rule)
+		}
+	}
+}
+
+func TestFilterMerge(t *testing.T) {
+	dir := t.TempDir()
+	src := "# comment\n; comment\n\n- *.tmp\n+ /keep/***\n- /*\n"
+	if err := os.WriteFile(filepath.Join(dir, "rules"), []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Merged rules are inserted in place of merge rule, relative to dir of config
+	filters := filters_parse(t, "", dir, "+ x.tmp", ". rules", "+ *")
+	for path, rule := range map[string]string{
+		"/r/x.tmp": "+ x.tmp",
+		"/r/a/y.tmp": "- *.tmp",
+		"/r/keep/a": "+ /keep/***",
+		"/r/other": "- /*",
+		"/r/a/b": "+ *",
+	} {
+		if matched := filters_match(filters, "/r", path); matched != rule {
+			t.Errorf("path %q: matched %q, expected %q", path, matched, rule)
+		}
+	}
+
+	// Rules from per-directory files are anchored to that dir
+	filters = filters_parse(t, "/r/d", "/r/d", "- /x", "- y")
+	for path, rule := range map[string]string{
+		"/r/d/x": "- /x",
+		"/r/d/e/x": "",
+		"/r/d/e/y": "- y",
+	} {
+		if matched := filters_match(filters, "/r", path); matched != rule {
+			t.Errorf("path %q (base /r/d): matched %q, expected %q", path, matched, rule)
+		}
+	}
+}
+
+func TestFilterPredFiles(t *testing.T) {
+	dir := t.TempDir()
+	for name, size := range map[string]int{"small": 10, "kb": 1024, "big": 4096} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, make([]byte, size), 0640); err != nil {
+			t.Fatal(err)
+		}
+		// Permissions set on create depend on umask
+		if err := os.Chmod(path, 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range []struct {
+		rule, name string
+		match bool
+	}{
+		{"- size:<100b", "small", true},
+		{"- size:<100B", "kb", false},
+		{"- size:1k", "kb", true},
+		{"- size:>=1KB", "kb", true},
+		{"- size:>1K", "kb", false},
+		{"- size:>1K", "big", true},
+		{"- size:<=4k", "big", true},
+		{"- mode:640", "small", true},
+		{"- mode:-600", "small", true},
+		{"- mode:-660", "small", false},
+		{"- mode:/111", "small", false},
+		{"- age:<1h", "small", true},
+		{"- age:>1d", "small", false},
+	} {
+		filters := filters_parse(t, "", "", c.rule)
+		path := filepath.Join(dir, c.name)
+		info, err := os.Lstat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		filter := filters.match(dir, tgrs.NewEntry(path, info.Mode(), info, nil))
+		if (filter != nil) != c.match {
+			t.Errorf("rule %q, file %v (size: %d): match=%v, expected %v",
+				c.rule, c.name, info.Size(), filter != nil, c.match)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package ignore
+
+import (
+	"strings"
+	re "regexp"
+)
+
+
+// Translate glob pattern to a regexp (without anchors), to match against
+//  slash-separated relative paths.
+// "*", "?" and "[...]" don't match slashes, "**" matches anything,
+//  and "**/" - any number of leading dirs, including none.
+func GlobRegexp(glob string) string {
+	var buff strings.Builder
+	for n := 0; n < len(glob); n++ {
+		c := glob[n]
+		switch c {
+			case '\\':
+				if n + 1 < len(glob) {
+					n++
+					buff.WriteString(re.QuoteMeta(glob[n:n+1]))
+				}
+			case '?':
+				buff.WriteString("[^/]")
+			case '*':
+				if n + 1 >= len(glob) || glob[n+1] != '*' {
+					buff.WriteString("[^/]*")
+					continue
+				}
+				for n + 1 < len(glob) && glob[n+1] == '*' {
+					n++
+				}
+				if n + 1 < len(glob) && glob[n+1] == '/' {
+					n++
+					buff.WriteString("(.*/)?")
+				} else {
+					buff.WriteString(".*")
+				}
+			case '[':
+				end := n + 1
+				if end < len(glob) && (glob[end] == '!' || glob[end] == '^') {
+					end++
+				}
+				if end < len(glob) && glob[end] == ']' {
+					end++
+				}
+				m := strings.IndexByte(glob[end:], ']')
+				if m < 0 {
+					buff.WriteString(`\[`)
+					continue
+				}
+				end += m
+				class := glob[n+1:end]
+				if class[0] == '!' {
+					class = "^" + class[1:]
+				}
+				buff.WriteString("[" + strings.ReplaceAll(class, "[", `\[`) + "]")
+				n = end
+			default:
+				buff.WriteString(re.QuoteMeta(glob[n:n+1]))
+		}
+	}
+	return buff.String()
+}
@@ -0,0 +1,317 @@
+// Package ignore implements matching of paths against ignore-lists of
+//  version control systems - .gitignore files (along with .git/info/exclude
+//  and core.excludesFile) and .hgignore, as well as listing of files tracked
+//  in git index.
+package ignore
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"bytes"
+	"bufio"
+	"strings"
+	"sync"
+	"path/filepath"
+	re "regexp"
+	"github.com/vaughan0/go-ini"
+)
+
+
+// Paths (relative to directory) that ignore-lists are read from,
+//  so that changes to these can be detected.
+var Inputs = []string{".git/info/exclude", ".gitignore", ".hgignore"}
+
+
+type rule struct {
+	pattern *re.Regexp
+	negate, dir_only bool
+	// Dirs are also matched with trailing slash, as hg does for "^dir/" regexps
+	dir_slash bool
+}
+
+type repo struct {
+	root string
+	// "git" or "hg"
+	kind string
+	// Tracked files and dirs (relative to root), if git index is used
+	tracked map[string]bool
+}
+
+// Ignore-rules for a directory, chained to ones of its parent dirs up to the
+//  repository root, created via Child() call on parent dir Matcher.
+// nil Matcher is valid and is used outside of any repositories.
+type Matcher struct {
+	parent *Matcher
+	// Dir that patterns are relative to
+	base string
+	rules []rule
+	repo *repo
+}
+
+// Return Matcher for a directory, given its parent dir Matcher (can be nil),
+//  which can be same as parent, if there are no new rules in this dir.
+// "has" should check whether dir contains path, as taggers.Entry.Contains does.
+// If "rules" is false, only git index (if "git_index" is set) is used, and vice-versa.
+// Returned error is for the first ignore-list that failed to be processed, if any,
+//  with Matcher still being valid in that case.
+func (m *Matcher) Child(dir string, has func(rel string) (os.FileMode, bool),
+		rules, git_index bool) (child *Matcher, err error) {
+	load := func(m *Matcher, base, path string, parse func([]byte) ([]rule, error)) *Matcher {
+		src, err_load := os.ReadFile(path)
+		if err_load == nil {
+			var list []rule
+			list, err_load = parse(src)
+			if len(list) > 0 {
+				m = &Matcher{parent: m, base: base, rules: list, repo: m.repo}
+			}
+		}
+		if err_load != nil && !os.IsNotExist(err_load) && err == nil {
+			err = fmt.Errorf("Failed to process ignore-list (%v): %v", path, err_load)
+		}
+		return m
+	}
+
+	if mode, ok := has(".git"); ok {
+		child = &Matcher{base: dir, repo: &repo{root: dir, kind: "git"}}
+		if git_index {
+			child.repo.tracked, err = git_tracked(dir)
+		}
+		if !rules {
+			return
+		}
+		excludes := git_excludes_global()
+		if mode.IsDir() {
+			git_conf, err_conf := ini.LoadFile(filepath.Join(dir, ".git/config"))
+			if err_conf == nil {
+				path, ok := git_config_excludes(git_conf)
+				if ok {
+					excludes = path
+				}
+			}
+		}
+		if len(excludes) > 0 {
+			child = load(child, dir, excludes, parse_gitignore)
+		}
+		if mode.IsDir() {
+			child = load(child, dir, filepath.Join(dir, ".git/info/exclude"), parse_gitignore)
+		}
+	} else if mode, ok := has(".hg"); ok && mode.IsDir() {
+		child = &Matcher{base: dir, repo: &repo{root: dir, kind: "hg"}}
+		if rules {
+			child = load(child, dir, filepath.Join(dir, ".hgignore"), parse_hgignore)
+		}
+		return
+	} else if m == nil || m.repo.kind != "git" || !rules {
+		return m, nil
+	} else {
+		child = m
+	}
+
+	if _, ok := has(".gitignore"); ok {
+		child = load(child, dir, filepath.Join(dir, ".gitignore"), parse_gitignore)
+	}
+	return
+}
+
+// Check whether path within Matcher dir should be skipped.
+func (m *Matcher) Ignored(path string, is_dir bool) bool {
+	if m == nil {
+		return false
+	}
+	// Repository dir itself is only skipped for git index, others leave it to filter rules
+	if m.repo.tracked != nil {
+		if filepath.Base(path) == "." + m.repo.kind && filepath.Dir(path) == m.repo.root {
+			return true
+		}
+		rel, err := filepath.Rel(m.repo.root, path)
+		if err == nil && m.repo.tracked[filepath.ToSlash(rel)] {
+			return false
+		}
+		return true
+	}
+	for ; m != nil; m = m.parent {
+		if len(m.rules) == 0 {
+			continue
+		}
+		rel, err := filepath.Rel(m.base, path)
+		if err != nil {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+		// Last matching rule in the list wins
+		for n := len(m.rules) - 1; n >= 0; n-- {
+			rule := m.rules[n]
+			if rule.dir_only && !is_dir {
+				continue
+			}
+			if rule.pattern.MatchString(rel) || (is_dir && rule.dir_slash && rule.pattern.MatchString(rel + "/")) {
+				return !rule.negate
+			}
+		}
+	}
+	return false
+}
+
+
+// Parse gitignore(5) patterns, which are relative to the dir of the ignore-list.
+func parse_gitignore(src []byte) (rules []rule, err error) {
+	lines := bufio.NewScanner(bytes.NewReader(src))
+	for lines.Scan() {
+		line := strings.TrimRight(lines.Text(), "\r")
+		// Trailing spaces are ignored, unless escaped
+		for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+			line = line[:len(line)-1]
+		}
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := rule{}
+		if strings.HasPrefix(line, "!") {
+			rule.negate, line = true, line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dir_only, line = true, strings.TrimRight(line, "/")
+		}
+		if len(line) == 0 {
+			continue
+		}
+		// Patterns with slashes are anchored to base dir, others match names at any level
+		pattern := "(^|/)"
+		if strings.Contains(line, "/") {
+			pattern, line = "^", strings.TrimPrefix(line, "/")
+		}
+		rule.pattern, err = re.Compile(pattern + GlobRegexp(line) + "$")
+		if err != nil {
+			return
+		}
+		rules = append(rules, rule)
+	}
+	return rules, lines.Err()
+}
+
+// Parse hgignore(5) patterns - regexps or globs, depending on "syntax:" lines or prefixes.
+// Patterns also match everything under matched dirs, as they do in hg.
+func parse_hgignore(src []byte) (rules []rule, err error) {
+	syntax := "relre"
+	lines := bufio.NewScanner(bytes.NewReader(src))
+	for lines.Scan() {
+		line := lines.Text()
+		// Comments start with unescaped "#"
+		for n := 0; n < len(line); n++ {
+			if line[n] == '#' && (n == 0 || line[n-1] != '\\') {
+				line = line[:n]
+				break
+			}
+		}
+		line = strings.TrimRight(strings.ReplaceAll(line, "\\#", "#"), " \t\r")
+		if len(line) == 0 {
+			continue
+		}
+		if strings.HasPrefix(line, "syntax:") {
+			switch strings.TrimSpace(line[7:]) {
+				case "re", "regexp":
+					syntax = "relre"
+				case "glob":
+					syntax = "relglob"
+				default:
+					return rules, fmt.Errorf("unknown syntax: %v", line)
+			}
+			continue
+		}
+		kind := syntax
+		if n := strings.Index(line, ":"); n > 0 {
+			switch line[:n] {
+				case "re", "regexp", "relre", "glob", "relglob", "rootglob", "path", "relpath":
+					kind, line = line[:n], line[n+1:]
+				case "include", "subinclude":
+					return rules, fmt.Errorf("includes are not supported: %v", line)
+			}
+		}
+		var pattern string
+		switch kind {
+			case "re", "regexp", "relre":
+				pattern = line
+			case "glob", "relglob":
+				pattern = "(^|/)" + GlobRegexp(line) + "(/|$)"
+			case "rootglob":
+				pattern = "^" + GlobRegexp(line) + "(/|$)"
+			case "path", "relpath":
+				pattern = "^" + re.QuoteMeta(strings.Trim(line, "/")) + "(/|$)"
+		}
+		rule := rule{dir_slash: true}
+		rule.pattern, err = re.Compile(pattern)
+		if err != nil {
+			return
+		}
+		rules = append(rules, rule)
+	}
+	return rules, lines.Err()
+}
+
+
+// Get core.excludesFile value from parsed git config file, if it's set there.
+func git_config_excludes(git_conf ini.File) (path string, ok bool) {
+	for k, v := range git_conf.Section("core") {
+		if strings.ToLower(k) == "excludesfile" {
+			return expand_user(strings.Trim(v, `"`)), true
+		}
+	}
+	return
+}
+
+var (
+	excludes_global string
+	excludes_global_once sync.Once
+)
+
+// Path to global excludes file - core.excludesFile from
+//  user's git config or $XDG_CONFIG_HOME/git/ignore default.
+func git_excludes_global() string {
+	excludes_global_once.Do(func() {
+		xdg := os.Getenv("XDG_CONFIG_HOME")
+		if len(xdg) == 0 {
+			xdg = expand_user("~/.config")
+		}
+		excludes_global = filepath.Join(xdg, "git/ignore")
+		for _, path := range []string{filepath.Join(xdg, "git/config"), expand_user("~/.gitconfig")} {
+			git_conf, err := ini.LoadFile(path)
+			if err != nil {
+				continue
+			}
+			if path, ok := git_config_excludes(git_conf); ok {
+				excludes_global = path
+			}
+		}
+	})
+	return excludes_global
+}
+
+func expand_user(path string) string {
+	if !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[2:])
+}
+
+// List files tracked in git index of the repository, along with all their parent dirs.
+func git_tracked(root string) (tracked map[string]bool, err error) {
+	cmd := exec.Command("git", "ls-files", "-z", "--cached")
+	cmd.Dir = root
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list files in git index (%v): %v", root, err)
+	}
+	tracked = make(map[string]bool)
+	for _, path := range strings.Split(string(out), "\x00") {
+		for len(path) > 0 && path != "." && !tracked[path] {
+			tracked[path] = true
+			path = filepath.ToSlash(filepath.Dir(path))
+		}
+	}
+	return
+}
@@ -0,0 +1,202 @@
+package ignore
+
+import (
+	"testing"
+	re "regexp"
+)
+
+
+func TestGlobRegexp(t *testing.T) {
+	for _, c := range []struct {
+		glob, path string
+		match bool
+	}{
+		{"*.go", "main.go", true},
+		{"*.go", "dir/main.go", false},
+		{"?.go", "a.go", true},
+		{"?.go", "ab.go", false},
+		{"a?c", "a/c", false},
+		{"[abc].txt", "b.txt", true},
+		{"[!abc].txt", "b.txt", false},
+		{"[!abc].txt", "d.txt", true},
+		{"[^abc].txt", "d.txt", true},
+		{"[]x].txt", "].txt", true},
+		{"[a", "[a", true},
+		{"**", "a/b/c", true},
+		{"**/x", "x", true},
+		{"**/x", "a/b/x", true},
+		{"a/**/x", "a/x", true},
+		{"a/**/x", "a/b/c/x", true},
+		{"a/**/x", "b/x", false},
+		{"a/**", "a/b/c", true},
+		{"\\*.go", "*.go", true},
+		{"\\*.go", "x.go", false},
+		{"a.b", "axb", false},
+	} {
+		pattern := re.MustCompile("^" + GlobRegexp(c.glob) + "$")
+		if match := pattern.MatchString(c.path); match != c.match {
+			t.Errorf("glob %q (regexp: %v) for path %q: match=%v, expected %v",
+				c.glob, pattern, c.path, match, c.match)
+		}
+	}
+}
+
+
+// Matcher chain for dirs from repository root down, with ignore-list for each one.
+func matcher_chain(t *testing.T, parse func([]byte) ([]rule, error), kind string,
+		dirs []string, lists []string) (m *Matcher) {
+	repo := &repo{root: dirs[0], kind: kind}
+	for n, dir := range dirs {
+		rules, err := parse([]byte(lists[n]))
+		if err != nil {
+			t.Fatalf("failed to parse ignore-list for %v: %v", dir, err)
+		}
+		m = &Matcher{parent: m, base: dir, rules: rules, repo: repo}
+	}
+	return
+}
+
+type ignore_case struct {
+	path string
+	is_dir, ignored bool
+}
+
+func check_ignored(t *testing.T, m *Matcher, cases []ignore_case) {
+	for _, c := range cases {
+		if ignored := m.Ignored(c.path, c.is_dir); ignored != c.ignored {
+			t.Errorf("path %q (dir: %v): ignored=%v, expected %v", c.path, c.is_dir, ignored, c.ignored)
+		}
+	}
+}
+
+
+func TestGitignore(t *testing.T) {
+	root := matcher_chain(t, parse_gitignore, "git", []string{"/r"}, []string{
+		"# comment\n" +
+		"*.log\n" +
+		"!keep.log\n" +
+		"build/\n" +
+		"/top\n" +
+		"doc/*.html\n" +
+		"**/gen/*.c\n" +
+		"trailing  \n" +
+		"escaped\\ \n" +
+		"\\#hash\n" +
+		"\\!bang\n" })
+	check_ignored(t, root, []ignore_case{
+		{"/r/x.log", false, true},
+		{"/r/a/b/x.log", false, true},
+		{"/r/keep.log", false, false},
+		{"/r/a/keep.log", false, false},
+		// dir-only patterns
+		{"/r/build", true, true},
+		{"/r/a/build", true, true},
+		{"/r/build", false, false},
+		// patterns with slashes are anchored to ignore-list dir
+		{"/r/top", false, true},
+		{"/r/a/top", false, false},
+		{"/r/doc/x.html", false, true},
+		{"/r/a/doc/x.html", false, false},
+		{"/r/doc/a/x.html", false, false},
+		{"/r/gen/x.c", false, true},
+		{"/r/a/b/gen/x.c", false, true},
+		// trailing spaces are stripped, unless escaped
+		{"/r/trailing", false, true},
+		{"/r/escaped ", false, true},
+		{"/r/escaped", false, false},
+		{"/r/#hash", false, true},
+		{"/r/!bang", false, true},
+		{"/r/comment", false, false},
+		{"/r/x.txt", false, false},
+	})
+}
+
+func TestGitignoreNested(t *testing.T) {
+	m := matcher_chain(t, parse_gitignore, "git",
+		[]string{"/r", "/r/sub", "/r/sub/deep"},
+		[]string{"*.tmp\n*.log\n", "!*.log\nlocal/\n/only-here\n", "*.log\n"})
+	check_ignored(t, m, []ignore_case{
+		// Parent rules apply, unless nested list overrides them
+		{"/r/sub/deep/x.tmp", false, true},
+		{"/r/sub/deep/x.log", false, true},
+		{"/r/sub/deep/local", true, true},
+		{"/r/sub/deep/only-here", false, false},
+		{"/r/sub/deep/x.txt", false, false},
+	})
+	m = m.parent
+	check_ignored(t, m, []ignore_case{
+		{"/r/sub/x.log", false, false},
+		{"/r/sub/a/x.log", false, false},
+		{"/r/sub/x.tmp", false, true},
+		{"/r/sub/only-here", false, true},
+		{"/r/sub/a/only-here", false, false},
+	})
+	m = m.parent
+	check_ignored(t, m, []ignore_case{
+		{"/r/x.log", false, true},
+		{"/r/only-here", false, false},
+	})
+}
+
+func TestHgignore(t *testing.T) {
+	m := matcher_chain(t, parse_hgignore, "hg", []string{"/r"}, []string{
+		"# comment\n" +
+		"\\.o$\n" +
+		"^out/\n" +
+		"syntax: glob\n" +
+		"*.pyc\n" +
+		"node_modules\n" +
+		"rootglob:top/*.txt\n" +
+		"path:some/dir\n" +
+		"re:^ab+c$\n" +
+		"x\\#y\n" })
+	check_ignored(t, m, []ignore_case{
+		{"/r/a.o", false, true},
+		{"/r/a/b.o", false, true},
+		{"/r/a.oo", false, false},
+		// "^dir/" regexps match dirs themselves and everything in these
+		{"/r/out", true, true},
+		{"/r/out/x", false, true},
+		{"/r/out", false, false},
+		{"/r/x.pyc", false, true},
+		{"/r/a/x.pyc", false, true},
+		{"/r/node_modules", true, true},
+		{"/r/a/node_modules/x.js", false, true},
+		{"/r/top/x.txt", false, true},
+		{"/r/a/top/x.txt", false, false},
+		{"/r/some/dir", true, true},
+		{"/r/some/dir/x", false, true},
+		{"/r/some/dirx", false, false},
+		{"/r/abbc", false, true},
+		{"/r/abbcd", false, false},
+		{"/r/x#y", false, true},
+		{"/r/comment", false, false},
+	})
+
+	for _, src := range []string{"syntax: bogus\n", "include:other\n", "subinclude:x/.hgignore\n"} {
+		if _, err := parse_hgignore([]byte(src)); err == nil {
+			t.Errorf("no error for hgignore: %q", src)
+		}
+	}
+}
+
+func TestIgnoredRepoDir(t *testing.T) {
+	// Without git index, .git is left to filter rules
+	m := matcher_chain(t, parse_gitignore, "git", []string{"/r"}, []string{"*.log\n"})
+	check_ignored(t, m, []ignore_case{
+		{"/r/.git", true, false},
+		{"/r/.git/config", false, false},
+	})
+	m.repo.tracked = map[string]bool{"a.go": true, "sub": true, "sub/b.go": true}
+	check_ignored(t, m, []ignore_case{
+		{"/r/.git", true, true},
+		{"/r/a.go", false, false},
+		{"/r/sub", true, false},
+		{"/r/sub/b.go", false, false},
+		{"/r/c.go", false, true},
+		{"/r/sub/.git", true, true},
+	})
+
+	var nil_matcher *Matcher
+	check_ignored(t, nil_matcher, []ignore_case{{"/x.log", false, false}})
+}
@@ -0,0 +1,110 @@
+package index
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"sort"
+	"path/filepath"
+	"encoding/gob"
+)
+
+
+// Default location of the index file, with "~" to be expanded by the caller.
+const PathDefault = "~/.codetag.index"
+
+// Tags and some file metadata, stored for each path in the index.
+type Entry struct {
+	Tags []string
+	Mtime int64
+	Size int64
+}
+
+// On-disk index of namespaced tags for paths.
+// Whole index is loaded into memory, and is replaced on disk atomically on Save.
+type Index struct {
+	Path string
+	Entries map[string]*Entry
+	// Paths that were updated since Load, to only check other ones on Prune.
+	updated map[string]bool
+}
+
+// Load index from the specified path, returning empty one if it doesn't exist yet.
+func Load(path string) (idx *Index, err error) {
+	idx = &Index{Path: path, Entries: make(map[string]*Entry), updated: make(map[string]bool)}
+	src, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	defer src.Close()
+	err = gob.NewDecoder(src).Decode(&idx.Entries)
+	if err == io.EOF {
+		err = nil
+	}
+	if err != nil {
+		err = fmt.Errorf("Failed to decode index file (%v): %v", path, err)
+	}
+	return
+}
+
+// Write index to a temporary file, then rename it over the old one.
+func (idx *Index) Save() (err error) {
+	dst, err := os.CreateTemp(filepath.Dir(idx.Path), "." + filepath.Base(idx.Path) + ".*.tmp")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			dst.Close()
+			os.Remove(dst.Name())
+		}
+	}()
+	err = gob.NewEncoder(dst).Encode(idx.Entries)
+	if err != nil {
+		return
+	}
+	err = dst.Close()
+	if err != nil {
+		return
+	}
+	return os.Rename(dst.Name(), idx.Path)
+}
+
+// Replace index entry for the path.
+func (idx *Index) Set(path string, entry *Entry) {
+	idx.Entries[path] = entry
+	idx.updated[path] = true
+}
+
+// Remove entries for paths that weren't updated and don't exist anymore.
+func (idx *Index) Prune() (n int) {
+	for path, _ := range idx.Entries {
+		if idx.updated[path] {
+			continue
+		}
+		_, err := os.Lstat(path)
+		if err != nil && os.IsNotExist(err) {
+			delete(idx.Entries, path)
+			n++
+		}
+	}
+	return
+}
+
+// Return sorted list of paths, tags of which match the query.
+func (idx *Index) Files(query Query) (paths []string) {
+	for path, entry := range idx.Entries {
+		tags := make(map[string]bool, len(entry.Tags))
+		for _, tag := range entry.Tags {
+			tags[tag] = true
+		}
+		if query(tags) {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return
+}
@@ -0,0 +1,140 @@
+package index
+
+import (
+	"fmt"
+	"strings"
+	"path"
+)
+
+
+// Compiled query, returning whether set of tags matches it.
+type Query func(tags map[string]bool) bool
+
+// Parse boolean query like "lang:go and (host:github or host:bitbucket) and not scm:*".
+// Adjacent terms without operator between them are implicitly joined with "and".
+// Operator precedence is the usual not > and > or.
+// Tags can contain shell-like wildcards (e.g. "lang:*" or "lang:c*"),
+//  which are matched against the whole "ns:value" tag string.
+func ParseQuery(query string) (q Query, err error) {
+	parser := query_parser{tokens: query_tokenize(query)}
+	if len(parser.tokens) == 0 {
+		return nil, fmt.Errorf("Empty query")
+	}
+	defer func() {
+		if err_parse := recover(); err_parse != nil {
+			q, err = nil, fmt.Errorf("Failed to parse query (%q): %v", query, err_parse)
+		}
+	}()
+	q = parser.parse_or()
+	if parser.pos < len(parser.tokens) {
+		panic(fmt.Errorf("unexpected token: %q", parser.tokens[parser.pos]))
+	}
+	return
+}
+
+func query_tokenize(query string) (tokens []string) {
+	query = strings.NewReplacer("(", " ( ", ")", " ) ").Replace(query)
+	return strings.Fields(query)
+}
+
+type query_parser struct {
+	tokens []string
+	pos int
+}
+
+func (parser *query_parser) peek() string {
+	if parser.pos >= len(parser.tokens) {
+		return ""
+	}
+	return parser.tokens[parser.pos]
+}
+
+func (parser *query_parser) next() (token string) {
+	token = parser.peek()
+	if len(token) == 0 {
+		panic(fmt.Errorf("unexpected end of query"))
+	}
+	parser.pos++
+	return
+}
+
+func (parser *query_parser) parse_or() Query {
+	terms := []Query{parser.parse_and()}
+	for strings.ToLower(parser.peek()) == "or" {
+		parser.next()
+		terms = append(terms, parser.parse_and())
+	}
+	if len(terms) == 1 {
+		return terms[0]
+	}
+	return func(tags map[string]bool) bool {
+		for _, term := range terms {
+			if term(tags) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func (parser *query_parser) parse_and() Query {
+	terms := []Query{parser.parse_not()}
+	for {
+		token := strings.ToLower(parser.peek())
+		if token == "and" {
+			parser.next()
+		} else if token == "" || token == "or" || token == ")" {
+			break
+		}
+		terms = append(terms, parser.parse_not())
+	}
+	if len(terms) == 1 {
+		return terms[0]
+	}
+	return func(tags map[string]bool) bool {
+		for _, term := range terms {
+			if !term(tags) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func (parser *query_parser) parse_not() Query {
+	if strings.ToLower(parser.peek()) == "not" {
+		parser.next()
+		term := parser.parse_not()
+		return func(tags map[string]bool) bool { return !term(tags) }
+	}
+	return parser.parse_term()
+}
+
+func (parser *query_parser) parse_term() Query {
+	token := parser.next()
+	switch strings.ToLower(token) {
+		case "(":
+			q := parser.parse_or()
+			if parser.next() != ")" {
+				panic(fmt.Errorf("missing closing parenthesis"))
+			}
+			return q
+		case ")", "and", "or":
+			panic(fmt.Errorf("unexpected token: %q", token))
+	}
+	if !strings.ContainsAny(token, "*?[") {
+		return func(tags map[string]bool) bool { return tags[token] }
+	}
+	_, err := path.Match(token, "")
+	if err != nil {
+		panic(fmt.Errorf("invalid wildcard pattern (%q): %v", token, err))
+	}
+	return func(tags map[string]bool) bool {
+		for tag, _ := range tags {
+			if ok, _ := path.Match(token, tag); ok {
+				return true
+			}
+		}
+		return false
+	}
+}
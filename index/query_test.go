@@ -0,0 +1,77 @@
+package index
+
+import (
+	"strings"
+	"testing"
+)
+
+
+func TestParseQuery(t *testing.T) {
+	for _, c := range []struct {
+		query, tags string
+		match bool
+	}{
+		{"lang:go", "lang:go scm:git", true},
+		{"lang:go", "lang:py", false},
+		{"lang:go", "", false},
+		// Implicit "and" between adjacent terms
+		{"lang:go scm:git", "lang:go scm:git", true},
+		{"lang:go scm:git", "lang:go", false},
+		{"lang:go AND scm:git", "lang:go scm:git", true},
+		{"lang:go or lang:py", "lang:py", true},
+		{"lang:go OR lang:py", "lang:c", false},
+		{"not lang:go", "lang:py", true},
+		{"not lang:go", "lang:go", false},
+		{"not not lang:go", "lang:go", true},
+		// Precedence: not > and > or
+		{"lang:go or lang:py and scm:git", "lang:go", true},
+		{"lang:go or lang:py and scm:git", "lang:py", false},
+		{"lang:go or lang:py and scm:git", "lang:py scm:git", true},
+		{"not lang:go and scm:git", "scm:git", true},
+		{"not lang:go and scm:git", "lang:go scm:git", false},
+		{"not lang:go or scm:git", "lang:go scm:git", true},
+		{"(lang:go or lang:py) and scm:git", "lang:go", false},
+		{"(lang:go or lang:py) and scm:git", "lang:py scm:git", true},
+		{"not (lang:go or lang:py)", "lang:py", false},
+		{"not (lang:go or lang:py)", "lang:c", true},
+		{"((lang:go))", "lang:go", true},
+		{"lang:go (host:github or host:bitbucket)", "lang:go host:bitbucket", true},
+		{"lang:go(host:github)", "lang:go host:github", true},
+		// Wildcards match whole tag strings
+		{"lang:*", "lang:go", true},
+		{"lang:*", "scm:git", false},
+		{"lang:c*", "lang:cpp", true},
+		{"lang:c*", "lang:go", false},
+		{"lang:?o", "lang:go", true},
+		{"lang:[gp]*", "lang:py", true},
+		{"lang:[gp]*", "lang:c", false},
+		{"*:git", "scm:git", true},
+		{"not scm:*", "lang:go", true},
+		{"not scm:*", "lang:go scm:hg", false},
+		// Tags in "_none" namespace don't have a prefix
+		{"mine", "mine lang:go", true},
+		{"mine", "lang:mine", false},
+	} {
+		q, err := ParseQuery(c.query)
+		if err != nil {
+			t.Errorf("query %q: unexpected error: %v", c.query, err)
+			continue
+		}
+		tags := make(map[string]bool)
+		for _, tag := range strings.Fields(c.tags) {
+			tags[tag] = true
+		}
+		if match := q(tags); match != c.match {
+			t.Errorf("query %q, tags %q: match=%v, expected %v", c.query, c.tags, match, c.match)
+		}
+	}
+
+	for _, query := range []string{
+		"", "  ", "and", "or", "not", "lang:go and", "lang:go or", "and lang:go",
+		"(lang:go", "lang:go)", "()", "(lang:go or) scm:git", "lang:[go",
+	} {
+		if _, err := ParseQuery(query); err == nil {
+			t.Errorf("query %q: no error", query)
+		}
+	}
+}
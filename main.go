@@ -6,16 +6,14 @@ import (
 	"flag"
 	"os"
 	"os/user"
-	"os/exec"
 	"path/filepath"
+	"bufio"
 	"bytes"
-	"encoding/gob"
+	"sort"
+	"runtime"
 	"text/template"
-	re "regexp"
 	"github.com/vaughan0/go-logging"
-	"github.com/kylelemons/go-gypsy/yaml"
-	"codetag/log_setup"
-	tgrs "codetag/taggers"
+	"codetag/index"
 )
 
 
@@ -52,83 +50,253 @@ var config_search = []path_t{"", "~/.codetag.yaml", "/etc/codetag.yaml"}
 // CLI
 // Config file that is used.
 var config_path string
-// Don't actually run tmsu
+// Don't actually store tags anywhere
 var dry_run bool
+// Remove stale tags in managed namespaces
+var sync_tags bool
+// Only report changes that would be made to stdout
+var diff bool
+// Print tags to stdout in specified format instead of using configured backend
+var output_format string
+// Ignore cached state from previous runs
+var rescan bool
+// Number of concurrent tagger workers
+var jobs_count int
+// Validate configuration file before using it
+var strict bool
+// Subcommand and its arguments
+var command = "scan"
+var command_args []string
+
+// Subcommand name, synopsis of its arguments and function to run it with.
+type command_t struct {
+	name, args string
+	run func(config *config_t, args []string) int
+}
+
+// Supported subcommands, with first one used by default.
+var commands = []command_t{
+	{"scan", "[ <path>... ]", cmd_scan},
+	{"tag", "[ --files-from <file> [ -0 ] ] [ <file>... ]", cmd_tag},
+	{"files", "[ -0 ] <query>...", cmd_files},
+	{"watch", "[ --debounce <seconds> ]", cmd_watch},
+	{"explain", "<path>...", cmd_explain},
+	{"check-config", "", cmd_check_config},
+}
 
+func command_get(name string) (cmd command_t, ok bool) {
+	for _, cmd = range commands {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+	return
+}
 
-type ctx_t map[string]map[string]interface{}
 
-// Clone context object using gob serialization
-func ctx_clone(src, dst interface{}) {
-	var err error
-	buff := new(bytes.Buffer)
-	enc := gob.NewEncoder(buff)
-	dec := gob.NewDecoder(buff)
-	err = enc.Encode(src)
+// Process all configured paths or only specified ones.
+func cmd_scan(config *config_t, args []string) int {
+	flags := flag.NewFlagSet("scan", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %v [ <options> ] [ scan ] [ <path>... ]\n\n"+
+			"Tag files in all paths from configuration file, or only in specified ones.\n"+
+			"Paths within configured ones are processed same as with a full scan,\n"+
+			"i.e. using tags from dirs above them (e.g. scm:git for repository root),\n"+
+			"while any other paths are processed as separate roots.\n"+
+			"Same filters and taggers are used in both cases.\n\n"+
+			"\"scan\" command name can be omitted, unless first path is also a command name.\n", os.Args[0])
+	}
+	flags.Parse(args)
+
+	log := config.log
+	paths, err := paths_args(flags.Args())
 	if err != nil {
-		panic(err)
+		log.Error(err)
+		return 1
+	}
+	if config.taggers == nil {
+		return 0
 	}
-	err = dec.Decode(dst)
+	err = scan(config, paths)
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
+		return 1
 	}
+	log.Debug("Finished")
+	return 0
 }
 
-type ctx_stack_t struct {
-	slug string
-	ctx ctx_t
-}
-
-
-// Parsed filters.
-type path_filter struct {
-	verdict bool
-	pattern *re.Regexp
-}
-type path_filters []path_filter
+// Process specified files within configured paths, building their context from dirs above them.
+func cmd_tag(config *config_t, args []string) int {
+	flags := flag.NewFlagSet("tag", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %v [ <options> ] tag"+
+			" [ --files-from <file> [ -0 ] ] [ <file>... ]\n\n"+
+			"Tag specified files (or everything within dirs), which must be within configured paths.\n"+
+			"Only dirs above these are processed to get their context (e.g. scm:git tag for\n"+
+			"repository root), with same filters and taggers, so that tags are exactly same\n"+
+			"as would be produced on a full scan, which is useful for editor and VCS hooks.\n\n"+
+			"Example: git diff --name-only -z | %v tag --files-from - -0\n\n"+
+			"Options:\n", os.Args[0], os.Args[0])
+		flags.PrintDefaults()
+	}
+	files_from := flags.String("files-from", "", "Read list of paths to process"+
+		" from specified file (\"-\" for stdin), one per line. Missing paths are skipped.")
+	null := flags.Bool("0", false, "Paths in --files-from list are separated by NUL bytes instead of newlines.")
+	flags.Parse(args)
+	if flags.NArg() == 0 && len(*files_from) == 0 {
+		flags.Usage()
+		return 1
+	}
 
-// Match path against a list of regexp-filters and return whether it
-//  should be processed or not.
-func (filters *path_filters) match(path string) bool {
-	for _, filter := range *filters {
-		if filter.pattern.Match([]byte(path)) {
-			return filter.verdict
+	log := config.log
+	args = flags.Args()
+	if len(*files_from) > 0 {
+		list, err := paths_read(*files_from, *null)
+		if err != nil {
+			log.Errorf("Failed to read list of paths (%v): %v", *files_from, err)
+			return 1
+		}
+		for _, path := range list {
+			if _, err := os.Lstat(path); err != nil {
+				log.Debugf("Skipping path from list (%v): %v", path, err)
+				continue
+			}
+			args = append(args, path)
 		}
 	}
-	return true
+	paths, err := paths_args(args)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+	// Empty list shouldn't fall back to processing all paths, as scan would
+	if len(paths) == 0 {
+		log.Debugf("No existing paths to process in the list: %v", *files_from)
+		return 0
+	}
+	for _, path := range paths {
+		if root, _ := config.path_root(path); len(root) == 0 {
+			log.Errorf("Path is not within any of the configured paths: %v", path)
+			return 1
+		}
+	}
+	if config.taggers == nil {
+		return 0
+	}
+	err = scan(config, paths)
+	if err != nil {
+		log.Fatal(err)
+		return 1
+	}
+	return 0
 }
 
-
-// Writer which line-buffers data, passing each line to log_func
-type log_pipe struct {
-	log_func func(string)
-	buff string ""
+// Get list of unique absolute paths from command-line arguments,
+//  without ones within other paths on the list, as these are processed with them.
+func paths_args(args []string) (paths []string, err error) {
+	for _, path := range args {
+		path, err := filepath.Abs(path)
+		if err == nil {
+			_, err = os.Lstat(path)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failed to process path (%s): %v", path, err)
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	paths_top, tops := []string{}, make(map[string]bool)
+	for _, path := range paths {
+		nested := false
+		for dir := path; ; dir = filepath.Dir(dir) {
+			if nested = tops[dir]; nested || dir == filepath.Dir(dir) {
+				break
+			}
+		}
+		if !nested {
+			paths_top, tops[path] = append(paths_top, path), true
+		}
+	}
+	return paths_top, nil
 }
 
-func (pipe *log_pipe) Log(line string) {
-	pipe.log_func(strings.TrimSpace(line))
+// Read list of newline- or NUL-separated paths from a file or stdin ("-").
+func paths_read(src string, null bool) (paths []string, err error) {
+	file := os.Stdin
+	if src != "-" {
+		file, err = os.Open(src)
+		if err != nil {
+			return
+		}
+		defer file.Close()
+	}
+	sep := byte('\n')
+	if null {
+		sep = 0
+	}
+	lines := bufio.NewScanner(file)
+	lines.Buffer(nil, 1 << 20)
+	lines.Split(func(data []byte, eof bool) (n int, token []byte, err error) {
+		if n := bytes.IndexByte(data, sep); n >= 0 {
+			return n + 1, data[:n], nil
+		}
+		if eof && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+	for lines.Scan() {
+		path := lines.Text()
+		if !null {
+			path = strings.TrimRight(path, "\r")
+		}
+		if len(path) > 0 {
+			paths = append(paths, path)
+		}
+	}
+	return paths, lines.Err()
 }
 
-func (pipe *log_pipe) Write(p []byte) (n int, err error) {
-	pipe.buff += string(p)
-	for strings.Contains(pipe.buff, "\n") {
-		lines := strings.SplitN(pipe.buff, "\n", 2)
-		pipe.Log(lines[0])
-		pipe.buff = lines[1]
-	}
-	return len(p), nil
-}
 
-func (pipe *log_pipe) Flush() {
-	if len(pipe.buff) > 0 {
-		pipe.Log(pipe.buff)
+// List files from tag index, matching a query.
+func cmd_files(config *config_t, args []string) int {
+	flags := flag.NewFlagSet("files", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %v [ <options> ] files [ -0 ] <query>...\n\n"+
+			"List files in codetag index (see 'index' output backend), matching the query.\n"+
+			"Query example: lang:go and host:github and not (scm:hg or lang:c*)\n\n"+
+			"Options:\n", os.Args[0])
+		flags.PrintDefaults()
 	}
-	pipe.buff = ""
-}
+	null := flags.Bool("0", false, "Separate paths with NUL bytes instead of newlines.")
+	flags.Parse(args)
 
-
-func init() {
-	gob.Register(tgrs.CtxTagset{})
+	log := config.log
+	query, err := index.ParseQuery(strings.Join(flags.Args(), " "))
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+	idx, err := index.Load(config.index_path)
+	if err != nil {
+		log.Errorf("Failed to load index: %v", err)
+		return 1
+	}
+	sep := "\n"
+	if *null {
+		sep = "\x00"
+	}
+	out := bufio.NewWriter(os.Stdout)
+	for _, path := range idx.Files(query) {
+		out.WriteString(path + sep)
+	}
+	err = out.Flush()
+	if err != nil {
+		log.Errorf("Failed to write output: %v", err)
+		return 1
+	}
+	return 0
 }
 
 
@@ -137,9 +305,11 @@ func main() {
 
 	flag.Usage = func() {
 		tpl := template.Must(template.New("test").Parse(""+
-			`usage: {{.cmd}} [ <options> ]
-
+			`usage: {{.cmd}} [ <options> ] [ <path>... ]
+{{range .commands}}       {{$.cmd}} [ <options> ] {{.}}
+{{end}}
 Index code files, using parameters specified in the config file.
+Only specified paths are processed, if any, instead of all configured ones.
 If not specified exmplicitly, config file is searched within the
 following paths (in that order):
 {{range .paths}}  - {{.}}
@@ -147,20 +317,48 @@ following paths (in that order):
 Examples:
   % {{.cmd}}
   % {{.cmd}} --config config.yaml
+  % {{.cmd}} ~/projects/some-repo
+  % {{.cmd}} tag ~/projects/some-repo/main.go
+  % {{.cmd}} watch
+  % {{.cmd}} explain ~/projects/some-repo/main.go
+  % {{.cmd}} files -0 lang:py and host:github | xargs -0 grep some_code_feature
 
 Options:
 `))
-		tpl.Execute(os.Stdout, map[string]interface{}{"cmd": os.Args[0], "paths": config_search})
+		cmd_usage := make([]string, len(commands))
+		for n, cmd := range commands {
+			cmd_usage[n] = cmd.name + " " + cmd.args
+		}
+		tpl.Execute(os.Stdout, map[string]interface{}{
+			"cmd": os.Args[0], "paths": config_search, "commands": cmd_usage})
 		flag.PrintDefaults()
 	}
 
 	flag.StringVar(&config_path, "config", "", "Configuration file to use.")
-	flag.BoolVar(&dry_run, "dry-run", false, "Don't actually run tmsu, just process all paths.")
+	flag.BoolVar(&dry_run, "dry-run", false, "Don't actually run tmsu"+
+		" (or any other output backend), just process all paths.")
+	flag.BoolVar(&sync_tags, "sync", false, "Remove tags in namespaces defined under 'taggers'"+
+		" from processed files, if these weren't produced on this run.")
+	flag.BoolVar(&diff, "diff", false, "Don't change anything, only print which"+
+		" tags would be added/removed (latter only with --sync) for each file to stdout.")
+	flag.BoolVar(&rescan, "rescan", false, "Process all paths, even if these"+
+		" weren't changed since the last run (see 'cache' config section).")
+	flag.IntVar(&jobs_count, "jobs", runtime.NumCPU(), "Number of files to run taggers on"+
+		" concurrently. Results are still passed to the output backend in a fixed order.")
+	flag.StringVar(&output_format, "output-format", "", "Print all files and their tags to stdout"+
+		" in specified format (jsonl, tsv, tree) instead of using configured output backend.")
+	flag.BoolVar(&strict, "strict", false, "Validate configuration file before doing anything,"+
+		" reporting all issues in it and exiting with error if there are any (see check-config command).")
 	flag.Parse()
+	if jobs_count < 1 {
+		jobs_count = 1
+	}
 	if flag.NArg() > 0 {
-		fmt.Fprintf(os.Stderr, "Error: no command-line"+
-			" arguments are allowed (provided: %v)\n", flag.Args())
-		os.Exit(1)
+		// Anything that isn't a command name is a path for the default command
+		command, command_args = flag.Arg(0), flag.Args()[1:]
+		if _, ok := command_get(command); !ok {
+			command, command_args = commands[0].name, flag.Args()
+		}
 	}
 
 	// Find config path to use
@@ -183,335 +381,27 @@ Options:
 		}
 	}
 
-	var (
-		log *logging.Logger
-		log_init = false
-		config_init = false
-	)
-
-	defer func() {
-		if config_init {
-			return
+	// Any issues in configuration are logged and skipped on load, but can be fatal here
+	if strict || command == "check-config" {
+		errs := config_check(config_path)
+		for _, err := range errs {
+			fmt.Fprintf(os.Stderr, "Configuration error (%v): %v\n", config_path, err)
 		}
-		// Recover only for configuration issues.
-		if err := recover(); err != nil {
-			if log_init {
-				log.Fatalf("Failed to process configuration file (%q): %v", config_path, err)
-			} else {
-				fmt.Fprintf(os.Stderr, "Failed to process configuration file (%q): %v\n", config_path, err)
-			}
+		if len(errs) > 0 {
 			os.Exit(1)
 		}
-	}()
-
-	// Read the config as yaml
-	config, err := yaml.ReadFile(config_path)
-	if err != nil {
-		panic(err)
-		os.Exit(1)
 	}
 
-	// Configure logging
-	log = logging.Get("codetag")
-
-	// Common processing vars
-	var (
-		ok bool
-		node yaml.Node
-		config_map yaml.Map
-		config_list yaml.List
-	)
-
-	node, err = yaml.Child(config.Root, ".logging")
-	if err != nil || node == nil {
-		logging.DefaultSetup()
-		log.Debugf("No logging config defined (err: %#v), using defaults", err)
-	} else {
-		config_map, ok = node.(yaml.Map)
-		if !ok {
-			logging.DefaultSetup()
-			log.Error("'logging' config section is not a map, ignoring")
+	config, log_init, err := config_load(config_path)
+	if err != nil {
+		if log_init {
+			logging.Get("codetag").Fatalf("Failed to process configuration file (%q): %v", config_path, err)
 		} else {
-			err = log_setup.SetupYAML(config_map)
-			if err != nil {
-				logging.DefaultSetup()
-				log.Errorf("Failed to configure logging: %v", err)
-			}
+			fmt.Fprintf(os.Stderr, "Failed to process configuration file (%q): %v\n", config_path, err)
 		}
-	}
-
-	log_init = true
-
-	// Configure filtering
-	filters := path_filters{}
-	node, err = yaml.Child(config.Root, ".filter")
-	if err != nil || node == nil {
-		log.Debug("No path-filters configured")
-	} else {
-		config_list, ok = node.(yaml.List)
-		if !ok {
-			log.Fatal("'filters' must be a list of string patterns")
-			os.Exit(1)
-		}
-		for _, node := range config_list {
-			pattern, ok := node.(yaml.Scalar)
-			if !ok {
-				log.Errorf("Pattern must be a string: %v", node)
-				continue
-			}
-			filter, pattern_str := path_filter{}, strings.Trim(string(pattern), "'")
-			filter.verdict = strings.HasPrefix(pattern_str, "+")
-			if !filter.verdict && !strings.HasPrefix(pattern_str, "-") {
-				log.Errorf("Pattern must start with either '+' or '-': %v", pattern_str)
-				continue
-			}
-			pattern_str = pattern_str[1:]
-			filter.pattern, err = re.Compile(pattern_str)
-			if err != nil {
-				log.Errorf("Failed to compile pattern (%v) as regexp: %v", pattern_str, err)
-				continue
-			}
-			filters = append(filters, filter)
-		}
-	}
-
-	// Get the list of paths to process
-	config_map, ok = config.Root.(yaml.Map)
-	if !ok {
-		log.Fatal("Config must be a map and have 'paths' key")
 		os.Exit(1)
 	}
 
-	node, ok = config_map["paths"]
-	if !ok {
-		log.Fatal("'paths' list must be defined in config")
-		os.Exit(1)
-	}
-
-	var paths []string
-	config_list, ok = node.(yaml.List)
-	if !ok {
-		path, ok := node.(yaml.Scalar)
-		if !ok {
-			log.Fatal("'paths' must be a list or (worst-case) scalar")
-			os.Exit(1)
-		}
-		paths = append(paths, string(path))
-	} else {
-		for _, node := range config_list {
-			path, ok := node.(yaml.Scalar)
-			if !ok {
-				log.Warnf("Skipped invalid path specification: %v", node)
-			} else {
-				paths = append(paths, string(path))
-			}
-		}
-	}
-
-	// Init taggers
-	node, ok = config_map["taggers"]
-	if ok {
-		config_map, ok = node.(yaml.Map)
-	}
-	if !ok {
-		log.Warn("No 'taggers' defined, nothing to do")
-		os.Exit(0)
-	}
-
-	taggers := make(map[string][]tgrs.Tagger)
-
-	init_tagger := func(ns, name string, config *yaml.Node) {
-		tagger, err := tgrs.Get(name, config, log)
-		if err != nil {
-			log.Warnf("Failed to init tagger %v (ns: %v): %v", ns, name, err)
-		} else {
-			taggers[ns] = append(taggers[ns], tagger)
-		}
-	}
-
-	for ns, node := range config_map {
-		if ns == "_none" {
-			ns = ""
-		}
-		if strings.HasPrefix(ns, "_") {
-			log.Warnf("Ignoring namespace name, starting with underscore: %v", ns)
-			continue
-		}
-
-		config_list, ok := node.(yaml.List)
-		if !ok {
-			// It's also ok to have "ns: tagger" spec, if there's just one for ns
-			tagger, ok := node.(yaml.Scalar)
-			if !ok {
-				log.Warnf("Invalid tagger(-list) specification (ns: %v): %v", ns, node)
-				continue
-			}
-			init_tagger(ns, string(tagger), nil)
-			continue
-		}
-
-		for _, node = range config_list {
-			tagger_map, ok := node.(yaml.Map)
-			if !ok {
-				tagger, ok := node.(yaml.Scalar)
-				if !ok {
-					log.Warnf("Invalid tagger specification - "+
-						"must be map or string (ns: %v): %v", ns, node)
-					continue
-				}
-				init_tagger(ns, string(tagger), nil)
-				continue
-			}
-			if len(tagger_map) != 1 {
-				log.Warnf("Invalid tagger specification - "+
-					"map must contain only one element (ns: %v): %v", ns, tagger_map)
-				continue
-			}
-			for tagger, node := range tagger_map {
-				init_tagger(ns, tagger, &node)
-				continue
-			}
-		}
-	}
-
-	config_init = true
-
-	// Walk the paths
-	var (
-		ctx ctx_t
-		ctx_stack_tuple ctx_stack_t
-		ctx_stack = make([]ctx_stack_t, 0)
-		ctx_tags tgrs.CtxTagset
-	)
-
-	log_tmsu := logging.Get("codetag.tmsu")
-	pipe := log_pipe{}
-	pipe.log_func = func(line string) {
-		log_tmsu.Debug(line)
-	}
-	tmsu_log_pipe := &pipe
-
-	ctx_stack = append(ctx_stack, ctx_stack_t{"", make(ctx_t)})
-
-	for _, root := range paths {
-		log.Tracef("Processing path: %s", root)
-
-		walk_iter := func (path string, info os.FileInfo, err error) (ret_err error) {
-			if err != nil {
-				log.Debugf(" - path: %v (info: %v), error: %v", path, info, err)
-				return
-			}
-
-			if !strings.HasPrefix(path, root) {
-				panic(fmt.Errorf("filepath.Walk went outside of root path (%v): %v", root, path))
-			}
-			path_match := path[len(root):]
-			if info.IsDir() {
-				path_match += "/"
-			}
-			if !filters.match(path_match) {
-				if info.IsDir() {
-					return filepath.SkipDir
-				}
-				return
-			}
-
-			// Get context for this path or copy it from parent path
-			n, slug := 0, path
-			for n, slug = range strings.Split(slug, fmt.Sprintf("%c", os.PathSeparator)) {
-				if len(ctx_stack) > n {
-					ctx_stack_tuple = ctx_stack[n]
-					if ctx_stack_tuple.slug == slug {
-						ctx = ctx_stack_tuple.ctx
-					} else {
-						ctx_stack_tuple = ctx_stack[n-1]
-						ctx = nil
-						ctx_clone(ctx_stack_tuple.ctx, &ctx)
-						ctx_stack[n] = ctx_stack_t{slug, ctx}
-						ctx_stack = ctx_stack[:n + 1]
-						break
-					}
-				} else {
-					ctx_stack_tuple = ctx_stack_t{slug, nil}
-					ctx_clone(ctx, &ctx_stack_tuple.ctx)
-					ctx_stack, ctx = append(ctx_stack, ctx_stack_tuple), ctx_stack_tuple.ctx
-				}
-			}
-			if len(ctx_stack) > n + 1 {
-				ctx_stack = ctx_stack[:n + 1]
-			}
-
-			// Run all taggers
-			for ns, tagger_list := range taggers {
-				ctx_ns, ok := ctx[ns]
-				if !ok {
-					ctx[ns] = make(map[string]interface{}, len(taggers) + 1)
-					ctx_ns = ctx[ns]
-				}
-				for _, tagger := range tagger_list {
-					tags := tagger(path, info, &ctx_ns)
-					if tags == nil {
-						continue
-					}
-					// Push new tags to the context
-					ctx_tags_if, ok := ctx_ns["tags"]
-					if !ok {
-						ctx_tags = make(tgrs.CtxTagset, len(taggers))
-					} else {
-						ctx_tags = ctx_tags_if.(tgrs.CtxTagset)
-					}
-					for _, tag := range tags {
-						_, ok = ctx_tags[tag]
-						if !ok {
-							ctx_tags[tag] = true
-						}
-					}
-					ctx_ns["tags"] = ctx_tags
-				}
-			}
-
-			// Attach tags only to files
-			if info.Mode() & os.ModeType != 0 {
-				return
-			}
-
-			file_tags := []string{}
-			for ns, ctx_ns := range ctx {
-				ctx_tags_if, ok := ctx_ns["tags"]
-				if !ok {
-					continue
-				}
-				ctx_tags = ctx_tags_if.(tgrs.CtxTagset)
-				for tag, _ := range ctx_tags {
-					file_tags = append(file_tags, ns + ":" + tag)
-				}
-			}
-
-			log.Tracef(" - file: %v, tags: %v", path, file_tags)
-			if !dry_run {
-				cmd := exec.Command("tmsu", "tag", path)
-				cmd.Args = append(cmd.Args, file_tags...)
-				cmd.Stdout, cmd.Stderr = tmsu_log_pipe, tmsu_log_pipe
-				err = cmd.Run()
-				if err != nil {
-					log.Fatalf("Failure running tmsu (file: %v, tags: %v): %v", path, file_tags, err)
-				}
-				tmsu_log_pipe.Flush()
-			}
-
-			return
-		}
-
-		path_ext, err := path_t(root).ExpandUser()
-		if err == nil {
-			root = string(path_ext)
-		}
-
-		err = filepath.Walk(root, walk_iter)
-		if err != nil {
-			log.Errorf("Failed to process path: %s", root)
-		}
-	}
-
-	log.Debug("Finished")
+	cmd, _ := command_get(command)
+	os.Exit(cmd.run(config, command_args))
 }
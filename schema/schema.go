@@ -0,0 +1,231 @@
+// Package schema implements validation of parsed YAML documents (go-gypsy nodes)
+//  against a description of their structure, reporting all issues found in there,
+//  along with key paths (e.g. "taggers.host[0]") to nodes that they are for.
+package schema
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	re "regexp"
+	"github.com/kylelemons/go-gypsy/yaml"
+)
+
+
+// Issue with a specific node in the document.
+type Error struct {
+	// Key path to the node, e.g. "output.batch_files" or "paths[1].path"
+	Path string
+	Err error
+}
+
+func (err *Error) Error() string {
+	if len(err.Path) == 0 {
+		return err.Err.Error()
+	}
+	return fmt.Sprintf("%v: %v", err.Path, err.Err)
+}
+
+// Schema checks node at the key path, returning errors for it and all nodes within it.
+// Node can be nil for keys with empty values.
+type Schema interface {
+	Check(node yaml.Node, path string) []error
+}
+
+// Check whole document against schema.
+func Check(doc *yaml.File, schema Schema) []error {
+	return schema.Check(doc.Root, "")
+}
+
+// Return error for the node at the key path.
+func Errorf(path, format string, args ...interface{}) error {
+	return &Error{path, fmt.Errorf(format, args...)}
+}
+
+// Key path for a child node of a map.
+func Key(path, key string) string {
+	if len(path) == 0 {
+		return key
+	}
+	return path + "." + key
+}
+
+// Key path for an item of a list.
+func Index(path string, n int) string {
+	return fmt.Sprintf("%v[%d]", path, n)
+}
+
+
+// Schema implemented as a function.
+type Func func(node yaml.Node, path string) []error
+
+func (schema Func) Check(node yaml.Node, path string) []error {
+	return schema(node, path)
+}
+
+// Scalar value, with optional check for its value.
+// Single quotes around the value are stripped, as they are elsewhere in configuration.
+type Scalar struct {
+	Value func(value string) error
+	// Name of expected value kind, for error messages, e.g. "an integer", default is "a string"
+	Kind string
+}
+
+func (schema Scalar) Check(node yaml.Node, path string) []error {
+	kind := schema.Kind
+	if len(kind) == 0 {
+		kind = "a string"
+	}
+	value, ok := node.(yaml.Scalar)
+	if !ok {
+		return []error{Errorf(path, "must be %v: %v", kind, node_repr(node))}
+	}
+	if schema.Value != nil {
+		if err := schema.Value(strings.Trim(string(value), "'")); err != nil {
+			return []error{Errorf(path, "%v", err)}
+		}
+	}
+	return nil
+}
+
+// List of values, each of which is checked against Item schema.
+type List struct {
+	Item Schema
+}
+
+func (schema List) Check(node yaml.Node, path string) (errs []error) {
+	list, ok := node.(yaml.List)
+	if !ok {
+		return []error{Errorf(path, "must be a list: %v", node_repr(node))}
+	}
+	for n, node := range list {
+		errs = append(errs, schema.Item.Check(node, Index(path, n))...)
+	}
+	return
+}
+
+// Map with known keys, values of which are checked against corresponding schemas.
+// Values for any other keys are checked against Values schema, and are errors if it's nil.
+type Map struct {
+	Keys map[string]Schema
+	Required []string
+	Values Schema
+}
+
+func (schema Map) Check(node yaml.Node, path string) (errs []error) {
+	conf, ok := node.(yaml.Map)
+	if !ok {
+		if node == nil && len(schema.Required) == 0 {
+			return
+		}
+		return []error{Errorf(path, "must be a map: %v", node_repr(node))}
+	}
+	for _, key := range schema.Required {
+		if _, ok := conf[key]; !ok {
+			errs = append(errs, Errorf(path, "missing required key: %v", key))
+		}
+	}
+	keys := make([]string, 0, len(conf))
+	for key, _ := range conf {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		key_schema, ok := schema.Keys[key]
+		if !ok {
+			key_schema = schema.Values
+		}
+		if key_schema == nil {
+			errs = append(errs, Errorf(Key(path, key), "unknown key"))
+			continue
+		}
+		errs = append(errs, key_schema.Check(conf[key], Key(path, key))...)
+	}
+	return
+}
+
+// Node that can be one of several kinds, each with its own schema (nil if not allowed).
+type Either struct {
+	Scalar, List, Map Schema
+	// Allow empty value
+	Null bool
+}
+
+func (schema Either) Check(node yaml.Node, path string) []error {
+	var node_schema Schema
+	switch node.(type) {
+		case yaml.Scalar:
+			node_schema = schema.Scalar
+		case yaml.List:
+			node_schema = schema.List
+		case yaml.Map:
+			node_schema = schema.Map
+		case nil:
+			if schema.Null {
+				return nil
+			}
+	}
+	if node_schema == nil {
+		kinds := []string{}
+		for kind, s := range map[string]Schema{
+				"a string": schema.Scalar, "a list": schema.List, "a map": schema.Map} {
+			if s != nil {
+				kinds = append(kinds, kind)
+			}
+		}
+		sort.Strings(kinds)
+		return []error{Errorf(path, "must be %v: %v", strings.Join(kinds, " or "), node_repr(node))}
+	}
+	return node_schema.Check(node, path)
+}
+
+
+// Common scalar schemas.
+var (
+	String = Scalar{}
+	Bool = Scalar{Kind: "either true or false", Value: func(value string) error {
+		if value != "true" && value != "false" {
+			return fmt.Errorf("must be either true or false: %v", value)
+		}
+		return nil
+	}}
+	PositiveInt = Scalar{Kind: "a positive integer", Value: func(value string) error {
+		if n, err := strconv.Atoi(value); err != nil || n <= 0 {
+			return fmt.Errorf("must be a positive integer: %v", value)
+		}
+		return nil
+	}}
+	Regexp = Scalar{Kind: "a regexp", Value: func(value string) error {
+		_, err := re.Compile(value)
+		return err
+	}}
+)
+
+// Scalar which must be one of the listed values.
+func Enum(values ...string) Scalar {
+	return Scalar{Value: func(value string) error {
+		for _, v := range values {
+			if value == v {
+				return nil
+			}
+		}
+		return fmt.Errorf("must be one of %v: %v", strings.Join(values, ", "), value)
+	}}
+}
+
+
+// Short representation of the node for error messages.
+func node_repr(node yaml.Node) string {
+	switch node := node.(type) {
+		case nil:
+			return "empty value"
+		case yaml.Scalar:
+			return fmt.Sprintf("%q", string(node))
+		case yaml.List:
+			return fmt.Sprintf("list of %d item(s)", len(node))
+		case yaml.Map:
+			return fmt.Sprintf("map with %d key(s)", len(node))
+	}
+	return fmt.Sprintf("%v", node)
+}
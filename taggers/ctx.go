@@ -0,0 +1,82 @@
+package taggers
+
+
+// Used to keep set of tags as keys.
+type CtxTagset map[string]bool
+
+// Layered copy-on-write context, passed to taggers for each path.
+// Each path gets its own layer with parent dir's context as a parent,
+//  so that creating one is cheap and values set for dir are seen in all paths within it.
+// Any Go values can be stored, but as these are shared with child contexts,
+//  they must never be modified in-place after Set - replace them with a modified copy instead.
+type Ctx struct {
+	parent *Ctx
+	values map[string]interface{}
+}
+
+// Marker for values that were deleted in a child layer, but are still set in parents.
+type ctx_deleted struct{}
+
+// Create new context layer, inheriting all values from parent (can be nil).
+func NewCtx(parent *Ctx) *Ctx {
+	return &Ctx{parent: parent}
+}
+
+// Return parent context layer or nil for the top-level one.
+func (ctx *Ctx) Parent() *Ctx {
+	return ctx.parent
+}
+
+// Lookup value in this context or the nearest parent that has it set.
+func (ctx *Ctx) Get(key string) (value interface{}, ok bool) {
+	for ; ctx != nil; ctx = ctx.parent {
+		value, ok = ctx.values[key]
+		if ok {
+			_, deleted := value.(ctx_deleted)
+			if deleted {
+				return nil, false
+			}
+			return
+		}
+	}
+	return nil, false
+}
+
+// Set value in this context layer, which doesn't affect parent contexts.
+func (ctx *Ctx) Set(key string, value interface{}) {
+	if ctx.values == nil {
+		ctx.values = make(map[string]interface{}, 1)
+	}
+	ctx.values[key] = value
+}
+
+// Unset value in this context layer, even if it's inherited from parents.
+func (ctx *Ctx) Delete(key string) {
+	if ctx.parent == nil {
+		delete(ctx.values, key)
+		return
+	}
+	ctx.Set(key, ctx_deleted{})
+}
+
+// Tags set in this context or inherited from parents, should not be modified.
+func (ctx *Ctx) Tags() CtxTagset {
+	tags_if, ok := ctx.Get("tags")
+	if !ok {
+		return nil
+	}
+	return tags_if.(CtxTagset)
+}
+
+// Add tags to this context layer, copying any inherited ones.
+func (ctx *Ctx) AddTags(tags []string) {
+	tags_prev := ctx.Tags()
+	tags_set := make(CtxTagset, len(tags_prev) + len(tags))
+	for tag, _ := range tags_prev {
+		tags_set[tag] = true
+	}
+	for _, tag := range tags {
+		tags_set[tag] = true
+	}
+	ctx.Set("tags", tags_set)
+}
@@ -0,0 +1,183 @@
+package taggers
+
+import (
+	"os"
+	"io"
+	"io/fs"
+	"bytes"
+	"sync"
+	"strings"
+	"path/filepath"
+)
+
+
+// Directory listing, read only once and shared between walker and taggers.
+type Listing struct {
+	Path string
+	// Entries, sorted by name
+	Entries []os.DirEntry
+	Err error
+	names map[string]os.DirEntry
+}
+
+// Cache of directory listings, safe for concurrent use.
+type Listings struct {
+	lock sync.Mutex
+	dirs map[string]*Listing
+}
+
+func NewListings() *Listings {
+	return &Listings{dirs: make(map[string]*Listing)}
+}
+
+// Return listing for the directory, reading it if it wasn't read yet.
+func (listings *Listings) Get(dir string) *Listing {
+	listings.lock.Lock()
+	defer listings.lock.Unlock()
+	listing, ok := listings.dirs[dir]
+	if ok {
+		return listing
+	}
+	listing = &Listing{Path: dir}
+	listing.Entries, listing.Err = os.ReadDir(dir)
+	listing.names = make(map[string]os.DirEntry, len(listing.Entries))
+	for _, entry := range listing.Entries {
+		listing.names[entry.Name()] = entry
+	}
+	listings.dirs[dir] = listing
+	return listing
+}
+
+// Drop cached listings for the directory and all paths within it.
+func (listings *Listings) Drop(dir string) {
+	listings.lock.Lock()
+	defer listings.lock.Unlock()
+	prefix := dir + string(filepath.Separator)
+	for path, _ := range listings.dirs {
+		if path == dir || strings.HasPrefix(path, prefix) {
+			delete(listings.dirs, path)
+		}
+	}
+}
+
+// Find entry by path relative to the directory (e.g. ".git/config"),
+//  using (and caching) listings of all intermediate dirs.
+// Symlinks are resolved, same as stat() would do, so only these need an extra syscall.
+func (listings *Listings) Lookup(dir, rel string) (entry os.DirEntry, ok bool) {
+	for _, name := range strings.Split(filepath.Clean(rel), string(filepath.Separator)) {
+		if entry != nil {
+			if !entry.IsDir() {
+				return nil, false
+			}
+			dir = filepath.Join(dir, entry.Name())
+		}
+		entry, ok = listings.Get(dir).names[name]
+		if !ok {
+			return nil, false
+		}
+		if entry.Type() & os.ModeSymlink != 0 {
+			info, err := os.Stat(filepath.Join(dir, name))
+			if err != nil {
+				return nil, false
+			}
+			entry = fs.FileInfoToDirEntry(info)
+		}
+	}
+	return entry, entry != nil
+}
+
+
+// Max size of file contents prefix, which is read for content-sniffing taggers.
+// Set from "scan" configuration section.
+var ContentBytes = 8192
+
+// Path that is being processed, passed to taggers.
+type Entry struct {
+	Path string
+	// Type bits of the path mode, as returned by lstat()
+	Mode os.FileMode
+	info os.FileInfo
+	listings *Listings
+
+	content_once sync.Once
+	content []byte
+	content_err error
+	binary bool
+}
+
+// Create Entry for the path, where info can be nil, to be requested on-demand.
+func NewEntry(path string, mode os.FileMode, info os.FileInfo, listings *Listings) *Entry {
+	return &Entry{Path: path, Mode: mode & os.ModeType, info: info, listings: listings}
+}
+
+func (entry *Entry) IsDir() bool {
+	return entry.Mode.IsDir()
+}
+
+// Return lstat() info for the path, which is only queried once.
+func (entry *Entry) Info() (info os.FileInfo, err error) {
+	if entry.info == nil {
+		entry.info, err = os.Lstat(entry.Path)
+	}
+	return entry.info, err
+}
+
+// Check whether directory contains specified relative path (e.g. ".git/config"),
+//  returning type bits of its mode (as returned by stat(), i.e. with symlinks resolved) if it does.
+func (entry *Entry) Contains(rel string) (mode os.FileMode, ok bool) {
+	if !entry.IsDir() {
+		return
+	}
+	dir_entry, ok := entry.listings.Lookup(entry.Path, rel)
+	if !ok {
+		return
+	}
+	return dir_entry.Type(), true
+}
+
+// Return stat() info for relative path within the directory, if it exists.
+func (entry *Entry) Stat(rel string) (info os.FileInfo, ok bool) {
+	if !entry.IsDir() {
+		return
+	}
+	dir_entry, ok := entry.listings.Lookup(entry.Path, rel)
+	if !ok {
+		return
+	}
+	info, err := dir_entry.Info()
+	return info, err == nil
+}
+
+// Return first ContentBytes (or less) of file contents, which are
+//  only read once, on first call, and shared between all taggers.
+// Should not be modified.
+func (entry *Entry) Content() ([]byte, error) {
+	entry.content_once.Do(func() {
+		if entry.Mode & os.ModeType != 0 {
+			entry.content_err = os.ErrInvalid
+			return
+		}
+		src, err := os.Open(entry.Path)
+		if err != nil {
+			entry.content_err = err
+			return
+		}
+		defer src.Close()
+		entry.content = make([]byte, ContentBytes)
+		n, err := io.ReadFull(src, entry.content)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+		}
+		entry.content, entry.content_err = entry.content[:n], err
+		// Same heuristic as used in git/grep - NUL bytes are not expected in text
+		entry.binary = bytes.IndexByte(entry.content, 0) >= 0
+	})
+	return entry.content, entry.content_err
+}
+
+// Whether file contents look like binary data, to be skipped by text-only taggers.
+// Reads contents prefix, if it wasn't read yet.
+func (entry *Entry) Binary() bool {
+	entry.Content()
+	return entry.binary
+}
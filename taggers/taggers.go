@@ -4,41 +4,81 @@ import (
 	"path/filepath"
 	"os"
 	"fmt"
-	"io"
-	"bufio"
+	"bytes"
 	"strings"
+	"sort"
 	re "regexp"
 	"github.com/vaughan0/go-logging"
 	"github.com/vaughan0/go-ini"
 	"github.com/kylelemons/go-gypsy/yaml"
+	"codetag/schema"
 )
 
 
 // Taggers are configurable routines that return a string tag(s) for a file,
 //  given it's location. What they do to that path (or files) is plugin-specific.
-type Tagger func(path string, info os.FileInfo, ctx *map[string]interface{}) []string
+type Tagger struct {
+	// Tagger type, e.g. "lang_detect_paths"
+	Name string
+	// Only run if there are no tags in namespace context yet
+	Fallback bool
+	// Returned tags are static "ns:value" strings (with "!" reset markers) for any namespace,
+	//  to be applied to the context after all other taggers, instead of added to namespace one
+	Static bool
+	run func(entry *Entry, ctx *Ctx) []string
+}
 
-// Used to keep set of tags as keys.
-type CtxTagset map[string]bool
+// Return tags for the path, if any.
+func (tagger *Tagger) Run(entry *Entry, ctx *Ctx) []string {
+	if tagger.Fallback && len(ctx.Tags()) > 0 {
+		return nil
+	}
+	return tagger.run(entry, ctx)
+}
 
 // Tagger before it is configured with "name" and "config".
 // Should return tags that should be associated with the file/dir.
-// Context value is passed to tagger plugins and
-//  is basically an arbitrary map plugins can set values in.
+// Entry should be used to check type of the path and contents of directories,
+//  instead of making separate syscalls, as these are shared between taggers.
+// Context value (see Ctx) is passed to tagger plugins and
+//  is basically an arbitrary key-value store plugins can set values in.
 // Context values are inherited along parent-child path relations - e.g.
 //  if plugin sets {x: 1} for /foo, it'll see {x: 1} in /foo/bar, but not /bar or /bar/asd.
-// "tags" key in context (sort.StringSlice) contains the tags that will be
+// Each tag namespace has its own separate context.
+// "tags" key in context (CtxTagset) contains the tags that will be
 //  applied to path in addition to what plugin will return and can be set/reset
 //  by plugin itself or inherited from parent folder.
 //  For example, "git" tag can be set once for directory that contains ".git"
 //   path and will then be applied to all files within.
 type tagger_func func(name string, config interface{},
-	log *logging.Logger, path string, info os.FileInfo, ctx *map[string]interface{}) []string
+	log *logging.Logger, entry *Entry, ctx *Ctx) []string
 type tagger_confproc func(name string, config *yaml.Node, log *logging.Logger) interface{}
 
 
-// Configure and return named "Tagger" function.
-func Get(name string, config *yaml.Node, log *logging.Logger) (Tagger, error) {
+// Paths (relative to directory) that taggers check to produce tags for the
+//  directory itself, which are then inherited by everything within it.
+// Used to detect whether these tags might've changed since the last run.
+var CtxInputs = []string{".git/config", ".hg/hgrc", tags_file_name}
+
+
+// Return schema for tagger configuration, or ok=false if there's no such tagger.
+// Tagger can be specified by name only (without configuration map) if schema has no Required keys.
+func Schema(name string) (conf schema.Map, ok bool) {
+	if _, ok = taggers[name]; !ok {
+		return
+	}
+	conf_map := schema.Map{Keys: map[string]schema.Schema{"fallback": schema.Bool}}
+	if conf_tagger, ok := taggers_schema[name]; ok {
+		for key, key_schema := range conf_tagger.Keys {
+			conf_map.Keys[key] = key_schema
+		}
+		conf_map.Required = conf_tagger.Required
+	}
+	return conf_map, true
+}
+
+// Configure and return named Tagger.
+func Get(name string, config *yaml.Node, log *logging.Logger) (*Tagger, error) {
 	// Check if tagger should only be used as a fallback
 	tagger_fallback := false
 	if config != nil {
@@ -62,21 +102,9 @@ func Get(name string, config *yaml.Node, log *logging.Logger) (Tagger, error) {
 	if !ok {
 		return nil, fmt.Errorf("Unknown tagger type: %v", name)
 	}
-	tagger := func(path string, info os.FileInfo, ctx *map[string]interface{}) (tags []string) {
-		// Check fallback condition
-		if tagger_fallback {
-			tags_prev_if, ok := (*ctx)["tags"]
-			if ok {
-				tags_prev, ok := tags_prev_if.(CtxTagset)
-				if !ok {
-					panic(fmt.Errorf("Failed to process tags from context: %v", *ctx))
-				}
-				if len(tags_prev) > 0 {
-					return
-				}
-			}
-		}
-		return tagger_func(name, tagger_conf, log, path, info, ctx)
+	tagger := &Tagger{Name: name, Fallback: tagger_fallback, Static: taggers_static[name]}
+	tagger.run = func(entry *Entry, ctx *Ctx) []string {
+		return tagger_func(name, tagger_conf, log, entry, ctx)
 	}
 	return tagger, nil
 }
@@ -84,16 +112,14 @@ func Get(name string, config *yaml.Node, log *logging.Logger) (Tagger, error) {
 
 // Assumes that there can be only one scm tag, so flushes previous tags if scm-path is detected.
 var scm_paths = map[string]string{".git": "git", ".hg": "hg", ".bzr": "bzr", ".svn": "svn"}
-func tagger_scm_detect_paths(name string, config interface{}, log *logging.Logger, path string, info os.FileInfo, ctx *map[string]interface{}) (tags []string) {
-	if !info.IsDir() {
+func tagger_scm_detect_paths(name string, config interface{}, log *logging.Logger, entry *Entry, ctx *Ctx) (tags []string) {
+	if !entry.IsDir() {
 		return
 	}
 	for dir, tag := range scm_paths {
-		info, err := os.Stat(filepath.Join(path, dir))
-		if err == nil && info.IsDir() {
-			if *ctx != nil {
-				delete(*ctx, "tags")
-			}
+		mode, ok := entry.Contains(dir)
+		if ok && mode.IsDir() {
+			ctx.Delete("tags")
 			tags = append(tags, tag)
 		}
 	}
@@ -139,37 +165,36 @@ var (
 	lang_shebang_regexps = []path_tag_pattern{}
 )
 
-func tagger_lang_detect_paths(name string, config interface{}, log *logging.Logger, path string, info os.FileInfo, ctx *map[string]interface{}) (tags []string) {
-	if info.Mode() & os.ModeType != 0 {
+func tagger_lang_detect_paths(name string, config interface{}, log *logging.Logger, entry *Entry, ctx *Ctx) (tags []string) {
+	if entry.Mode & os.ModeType != 0 {
 		return
 	}
 	for _, filter := range lang_path_regexps {
-		if filter.pattern.MatchString(path) {
+		if filter.pattern.MatchString(entry.Path) {
 			tags = append(tags, filter.tag)
 		}
 	}
 	return
 }
 
-func tagger_lang_detect_shebang(name string, config interface{}, log *logging.Logger, path string, info os.FileInfo, ctx *map[string]interface{}) (tags []string) {
-	if info.Mode() & os.ModeType != 0 {
+func tagger_lang_detect_shebang(name string, config interface{}, log *logging.Logger, entry *Entry, ctx *Ctx) (tags []string) {
+	if entry.Mode & os.ModeType != 0 {
 		return
 	}
 
-	src, err := os.Open(path)
+	content, err := entry.Content()
 	if err != nil {
-		log.Infof("Failed to open file (%v): %v", path, err)
+		log.Infof("Failed to read file (%v): %v", entry.Path, err)
 		return
 	}
-	defer src.Close()
-	src_r := bufio.NewReader(src)
-	line, err := src_r.ReadString('\n')
-	if err != nil {
-		if err != io.EOF {
-			log.Warnf("Failed to read first line from file (%v): %v", path, err)
-		}
+	if entry.Binary() || !bytes.HasPrefix(content, []byte("#!")) {
 		return
 	}
+	n := bytes.IndexByte(content, '\n')
+	if n < 0 {
+		return
+	}
+	line := string(content[:n])
 
 	interpreter := string(lang_shebang.ExpandString([]byte{},
 		"${interpreter}", line, lang_shebang.FindStringSubmatchIndex(line)))
@@ -195,6 +220,10 @@ var (
 func tagger_scm_host_confproc(name string, config *yaml.Node, log *logging.Logger) interface{} {
 	var err error
 
+	if config == nil {
+		log.Warnf("No 'host_tags' defined in tagger config (%v), it won't produce any tags", name)
+		return nil
+	}
 	node, err := yaml.Child(*config, "host_tags")
 	config_map, ok := yaml.Map{}, false
 	if err == nil {
@@ -229,16 +258,24 @@ func tagger_scm_host_confproc(name string, config *yaml.Node, log *logging.Logge
 	return tag_map
 }
 
-func tagger_scm_config_git(name string, config interface{}, log *logging.Logger, path string, info os.FileInfo, ctx *map[string]interface{}) (tags []string) {
-	if config == nil || !info.IsDir() {
+var tagger_scm_host_schema = schema.Map{Required: []string{"host_tags"},
+	Keys: map[string]schema.Schema{"host_tags": schema.Func(func(node yaml.Node, path string) []error {
+		if node == nil {
+			return []error{schema.Errorf(path, "no tags defined")}
+		}
+		return schema.Map{Values: schema.Regexp}.Check(node, path)
+	})}}
+
+func tagger_scm_config_git(name string, config interface{}, log *logging.Logger, entry *Entry, ctx *Ctx) (tags []string) {
+	if config == nil || !entry.IsDir() {
 		return
 	}
 
-	git_conf_path := filepath.Join(path, ".git/config")
-	info, err := os.Stat(git_conf_path)
-	if err != nil || info == nil || info.Mode() & os.ModeType != 0 {
+	mode, ok := entry.Contains(".git/config")
+	if !ok || mode & os.ModeType != 0 {
 		return
 	}
+	git_conf_path := filepath.Join(entry.Path, ".git/config")
 	git_conf, err := ini.LoadFile(git_conf_path)
 	if err != nil {
 		log.Warnf("Failed to parse git config (%v): %v", git_conf_path, err)
@@ -271,16 +308,16 @@ func tagger_scm_config_git(name string, config interface{}, log *logging.Logger,
 	return
 }
 
-func tagger_scm_config_hg(name string, config interface{}, log *logging.Logger, path string, info os.FileInfo, ctx *map[string]interface{}) (tags []string) {
-	if config == nil || !info.IsDir() {
+func tagger_scm_config_hg(name string, config interface{}, log *logging.Logger, entry *Entry, ctx *Ctx) (tags []string) {
+	if config == nil || !entry.IsDir() {
 		return
 	}
 
-	hgrc_path := filepath.Join(path, ".hg/hgrc")
-	info, err := os.Stat(hgrc_path)
-	if err != nil || info == nil || info.Mode() & os.ModeType != 0 {
+	mode, ok := entry.Contains(".hg/hgrc")
+	if !ok || mode & os.ModeType != 0 {
 		return
 	}
+	hgrc_path := filepath.Join(entry.Path, ".hg/hgrc")
 	hgrc, err := ini.LoadFile(hgrc_path)
 	if err != nil {
 		log.Warnf("Failed to parse hgrc config (%v): %v", hgrc_path, err)
@@ -306,6 +343,44 @@ func tagger_scm_config_hg(name string, config interface{}, log *logging.Logger,
 }
 
 
+// Name of files with manual tags for everything in the same directory.
+const tags_file_name = ".tags"
+
+// Reads tags from ".tags" file in a directory, one tag per line, with "#" comments,
+//  so that these are inherited by everything within it.
+// Static tagger - lines are returned as-is, and "client:acme" is added to "client" namespace,
+//  while "acme" - to the one that tagger is used in.
+// Lines starting with "!" remove inherited tags that are equal to or prefixed
+//  (as in namespace) by the rest of the line, e.g. "!client" removes "client:acme",
+//  while "!" on its own removes all inherited tags.
+func tagger_tags_file(name string, config interface{}, log *logging.Logger, entry *Entry, ctx *Ctx) (tags []string) {
+	if !entry.IsDir() {
+		return
+	}
+	mode, ok := entry.Contains(tags_file_name)
+	if !ok || mode & os.ModeType != 0 {
+		return
+	}
+	tags_path := filepath.Join(entry.Path, tags_file_name)
+	src, err := os.ReadFile(tags_path)
+	if err != nil {
+		log.Warnf("Failed to read tags file (%v): %v", tags_path, err)
+		return
+	}
+
+	for _, line := range strings.Split(string(src), "\n") {
+		if n := strings.Index(line, "#"); n >= 0 {
+			line = line[:n]
+		}
+		line = strings.TrimSpace(line)
+		if len(line) > 0 {
+			tags = append(tags, line)
+		}
+	}
+	return
+}
+
+
 // Map of available Tagger functions
 var taggers = map[string]tagger_func {
 	"scm_detect_paths": tagger_scm_detect_paths,
@@ -313,14 +388,27 @@ var taggers = map[string]tagger_func {
 	"lang_detect_shebang": tagger_lang_detect_shebang,
 	"scm_config_git": tagger_scm_config_git,
 	"scm_config_hg": tagger_scm_config_hg,
+	"tags_file": tagger_tags_file,
 }
 var taggers_confproc = map[string]tagger_confproc {
 	"scm_config_git": tagger_scm_host_confproc,
 	"scm_config_hg": tagger_scm_host_confproc,
 }
+// Taggers that return static tags for any namespace, see Tagger.Static
+var taggers_static = map[string]bool{"tags_file": true}
+// Schemas for tagger configuration maps, used for validation, without "fallback" key.
+var taggers_schema = map[string]schema.Map {
+	"scm_config_git": tagger_scm_host_schema,
+	"scm_config_hg": tagger_scm_host_schema,
+}
 
 
 func init() {
+	for dir, _ := range scm_paths {
+		CtxInputs = append(CtxInputs, dir)
+	}
+	sort.Strings(CtxInputs)
+
 	// Compile patterns for tagger_lang_detect_paths
 	for re_base, tag := range lang_ext_map {
 		re_base = "\\.(" + re_base +
@@ -0,0 +1,672 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"github.com/vaughan0/go-logging"
+	tgrs "codetag/taggers"
+	"codetag/cache"
+	"codetag/ignore"
+)
+
+
+// Context for each tag namespace, see taggers.Ctx.
+type ctx_t map[string]*tgrs.Ctx
+
+// Create child context for a path, with parent dir context (can be nil) as a parent.
+// Parent context can have namespaces added by per-directory configuration files.
+func ctx_child(parent ctx_t, namespaces map[string][]*tgrs.Tagger) (ctx ctx_t) {
+	ctx = make(ctx_t, len(namespaces))
+	for ns, _ := range namespaces {
+		ctx[ns] = tgrs.NewCtx(parent[ns])
+	}
+	for ns, ctx_ns := range parent {
+		if _, ok := ctx[ns]; !ok {
+			ctx[ns] = tgrs.NewCtx(ctx_ns)
+		}
+	}
+	return
+}
+
+// Return sorted list of namespaced tags (e.g. "lang:go") from context.
+func ctx_tags(ctx ctx_t) (tags []string) {
+	tags = []string{}
+	for ns, ctx_ns := range ctx {
+		for tag, _ := range ctx_ns.Tags() {
+			// Tags in "_none" namespace are used without prefix
+			if len(ns) > 0 {
+				tag = ns + ":" + tag
+			}
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	return
+}
+
+// State of the processed directory, inherited by paths within it.
+type walk_dir struct {
+	ctx ctx_t
+	// Fingerprint of context inputs, if state cache is used
+	ctx_fp uint64
+	// Filters, including rules from per-directory filter files
+	filters path_filters
+	// VCS ignore-lists, if enabled for the root
+	ignore *ignore.Matcher
+	// Path with all symlinks resolved, if it was reached via followed symlink
+	real string
+}
+
+// Device and inode numbers, to detect same paths reached in different ways.
+type file_id struct {
+	dev, ino uint64
+}
+
+
+
+// File to be processed by a tagger worker, and then passed to the backend by writer.
+type walk_job struct {
+	seq uint64
+	// Path to tag, which can be different from entry path for followed symlinks
+	path string
+	entry *tgrs.Entry
+	info os.FileInfo
+	ctx ctx_t
+	ctx_fp uint64
+	tags []string
+}
+
+// Runs taggers on paths within configured roots, passing resulting tags to the backend.
+// Processing is split into three stages, running concurrently:
+//  - Traversal of the paths, where filters are applied and directory-level taggers
+//    are run, as their results are inherited by everything within these dirs.
+//    Each directory is only listed once, and its listing is shared with taggers.
+//  - Pool of workers, running taggers for files in any order.
+//  - Single writer, passing tags for files to backend in the same order as traversal.
+type walker struct {
+	config *config_t
+	log *logging.Logger
+	state *cache.Cache
+	root string
+	opts scan_opts
+	listings *tgrs.Listings
+	// Configured paths, which are not processed within other ones, as they have own options
+	roots map[string]bool
+	// Configured paths with symlinks resolved, which symlinks are not followed into
+	roots_real []string
+	// Dirs (and files with multiple links) processed in all roots, with paths they were found at
+	seen map[file_id]string
+	// Symlinks are followed in some root, so all files are recorded in seen, as any can be reached via these
+	seen_files bool
+	// Device of the current root path
+	root_dev uint64
+	// Called for each directory that passes filters, if set
+	dir_hook func(path string)
+	// Records how paths are processed, if set, see explainer
+	explain *explainer
+
+	jobs chan *walk_job
+	results chan *walk_job
+	seq uint64
+	// Number of jobs not yet passed to the backend
+	pending sync.WaitGroup
+	workers sync.WaitGroup
+	writer_done chan struct{}
+}
+
+// Open output backend, load state cache (if enabled) and start tagger workers.
+func walker_new(config *config_t) (w *walker, err error) {
+	w = &walker{config: config, log: config.log,
+		listings: tgrs.NewListings(), seen: make(map[file_id]string)}
+	w.roots = make(map[string]bool, len(config.paths))
+	for _, root := range config.paths {
+		w.roots[filepath.Clean(root)] = true
+		if real, err := filepath.EvalSymlinks(root); err == nil {
+			w.roots_real = append(w.roots_real, real)
+		}
+	}
+	w.seen_files = config.scan.follow_symlinks
+	for _, opts := range config.paths_scan {
+		w.seen_files = w.seen_files || opts.follow_symlinks
+	}
+	if len(config.cache_path) > 0 {
+		w.state, err = cache.Load(config.cache_path, config.cache_key)
+		if err != nil {
+			w.log.Warnf("Failed to load state cache, ignoring it: %v", err)
+		}
+		if rescan {
+			w.state.Entries = make(map[string]*cache.Entry)
+		}
+	}
+	err = config.backend.Open()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open output backend (%v): %v", config.backend_name, err)
+	}
+
+	w.jobs, w.results = make(chan *walk_job, jobs_count * 4), make(chan *walk_job, jobs_count * 4)
+	for n := 0; n < jobs_count; n++ {
+		w.workers.Add(1)
+		go w.worker()
+	}
+	w.writer_done = make(chan struct{})
+	go w.writer()
+	return
+}
+
+// Run all taggers for the path, updating its context.
+// Taggers for namespace can be overridden in context by per-directory configuration files.
+func (w *walker) run_taggers(entry *tgrs.Entry, ctx ctx_t) {
+	// Static tags can be for any namespace, so are only applied after all other taggers
+	type static_tags struct {
+		ns, source string
+		tags []string
+	}
+	static := []static_tags{}
+	for ns, ctx_ns := range ctx {
+		tagger_list := w.config.taggers[ns]
+		if tagger_list_ctx, ok := ctx_ns.Get("taggers"); ok {
+			tagger_list = tagger_list_ctx.([]*tgrs.Tagger)
+		}
+		for _, tagger := range tagger_list {
+			if w.explain != nil && tagger.Fallback && len(ctx_ns.Tags()) > 0 {
+				w.explain.skipped(entry.Path, ns, tagger.Name, ctx_ns.Tags())
+			}
+			tags := tagger.Run(entry, ctx_ns)
+			if tags == nil {
+				continue
+			}
+			if tagger.Static {
+				static = append(static, static_tags{ns, tagger.Name, tags})
+				continue
+			}
+			w.explain.tagged(entry.Path, ns, tagger.Name, tags)
+			// Push new tags to the context
+			ctx_ns.AddTags(tags)
+		}
+	}
+	sort.Slice(static, func(i, j int) bool { return static[i].ns < static[j].ns })
+	for _, src := range static {
+		for ns, tags := range ctx_static_tags(ctx, src.ns, src.tags) {
+			w.explain.tagged(entry.Path, ns, src.source, tags)
+		}
+	}
+}
+
+// Runs taggers for files, passing results to writer.
+func (w *walker) worker() {
+	defer w.workers.Done()
+	for job := range w.jobs {
+		w.run_taggers(job.entry, job.ctx)
+		job.tags = ctx_tags(job.ctx)
+		if w.explain != nil {
+			w.explain.result = job.tags
+		}
+		job.ctx = nil
+		w.results <- job
+	}
+}
+
+// Passes tags for files to backend, in the same order as these were found by traversal.
+func (w *walker) writer() {
+	defer close(w.writer_done)
+	seq, queue := uint64(0), make(map[uint64]*walk_job)
+	for job := range w.results {
+		queue[job.seq] = job
+		for {
+			job, ok := queue[seq]
+			if !ok {
+				break
+			}
+			delete(queue, seq)
+			seq++
+			w.log.Tracef(" - file: %v, tags: %v", job.path, job.tags)
+			err := w.config.backend.Tag(job.path, job.info, job.tags)
+			if err != nil {
+				w.log.Error(err)
+			} else if w.state != nil {
+				w.state.Set(job.path, job.info, job.ctx_fp, &cache.Entry{Tags: job.tags})
+			}
+			w.pending.Done()
+		}
+	}
+}
+
+// Filter and tag path, returning state for paths within it, if it's a directory,
+//  or ok=false if it was filtered-out or can't be processed.
+// Parent dir state is nil for the root path.
+// Target is the resolved path for followed symlink, and should be empty otherwise.
+// Files are only queued for tagging, as they're processed by worker pool.
+func (w *walker) process(entry *tgrs.Entry, parent *walk_dir, target string) (dir *walk_dir, ok bool) {
+	path, log := entry.Path, w.log
+	if parent == nil {
+		parent = &walk_dir{filters: w.config.filters, ignore: w.ignore_root(path)}
+	}
+	real := target
+	if len(real) == 0 {
+		real = path
+		if len(parent.real) > 0 {
+			real = filepath.Join(parent.real, filepath.Base(path))
+		}
+	}
+
+	if !strings.HasPrefix(path, w.root) {
+		panic(fmt.Errorf("Walker went outside of root path (%v): %v", w.root, path))
+	}
+	if parent.ctx != nil && entry.IsDir() && w.roots[path] {
+		log.Debugf(" - path: %v, skipped as it's processed as a separate configured path", path)
+		w.explain.note(path, "skipped, as it's processed as a separate configured path")
+		return
+	}
+	filter := parent.filters.match(w.root, entry)
+	if filter != nil && !filter.verdict {
+		log.Tracef(" - path: %v, excluded by filter rule: %v", path, filter.rule)
+		w.explain.note(path, "excluded by filter rule: %v", filter.rule)
+		return
+	}
+	// Explicit "+" filters take priority over VCS ignore-lists
+	if filter == nil && parent.ignore.Ignored(path, entry.IsDir()) {
+		log.Tracef(" - path: %v, ignored by VCS ignore-list", path)
+		w.explain.note(path, "ignored by VCS ignore-list")
+		return
+	}
+	info, err := entry.Info()
+	if err != nil {
+		log.Debugf(" - path: %v, error: %v", path, err)
+		return
+	}
+	if stat, stat_ok := info.Sys().(*syscall.Stat_t); stat_ok {
+		if parent.ctx == nil {
+			w.root_dev = uint64(stat.Dev)
+		} else if w.opts.xdev && uint64(stat.Dev) != w.root_dev {
+			log.Tracef(" - path: %v, skipped as it's on a different filesystem", path)
+			w.explain.note(path, "skipped, as it's on a different filesystem")
+			return
+		}
+		// Same dir or file can be reached via overlapping roots, bind mounts, symlinks or hardlinks
+		if w.seen_files || entry.IsDir() || real != path || stat.Nlink > 1 {
+			id := file_id{uint64(stat.Dev), uint64(stat.Ino)}
+			if path_prev, seen := w.seen[id]; seen {
+				log.Noticef("Skipping path (%v), which was already processed as: %v", path, path_prev)
+				w.explain.note(path, "skipped, as it was already processed as: %v", path_prev)
+				return
+			}
+			w.seen[id] = path
+		}
+	}
+
+	var (
+		marker_rules path_filters
+		conf *dir_config
+	)
+	if entry.IsDir() {
+		var prune bool
+		prune, marker_rules, err = markers_check(entry, w.config.markers, w.opts.cachedir_tag)
+		if err != nil {
+			log.Warnf("Failed to process marker file in dir (%v): %v", path, err)
+		}
+		if prune && filter == nil {
+			log.Tracef(" - path: %v, skipped due to marker file", path)
+			w.explain.note(path, "skipped due to marker file")
+			return
+		}
+		conf, err = dir_config_load(entry, w.config)
+		if err != nil {
+			log.Warn(err)
+		}
+	}
+
+	// Included paths are only noted after all checks that can skip them
+	if filter != nil {
+		w.explain.note(path, "included by filter rule: %v", filter.rule)
+	} else {
+		w.explain.note(path, "no filter rules matched, included by default")
+	}
+	if w.dir_hook != nil && entry.IsDir() {
+		w.dir_hook(path)
+	}
+
+	// Symlinks are only tagged with "link:symlink" tag, if enabled
+	symlink_tag := entry.Mode & os.ModeSymlink != 0 && w.opts.symlink_tag
+
+	// Create context for this path as a child of its parent dir context
+	ctx, ctx_fp, ok := ctx_child(parent.ctx, w.config.taggers), parent.ctx_fp, true
+	if entry.IsDir() {
+		dir = &walk_dir{ctx: ctx, ignore: parent.ignore}
+		if real != path {
+			dir.real = real
+		}
+		dir.filters, err = parent.filters.dir_merge(entry)
+		if err != nil {
+			log.Warn(err)
+		}
+		if len(marker_rules) > 0 {
+			dir.filters = append(marker_rules, dir.filters...)
+		}
+		if conf != nil {
+			conf.apply(ctx)
+			if len(conf.filters) > 0 {
+				dir.filters = append(append(path_filters{}, conf.filters...), dir.filters...)
+			}
+		}
+		if w.opts.vcs_ignore || w.opts.git_index {
+			dir.ignore, err = parent.ignore.Child(path, entry.Contains, w.opts.vcs_ignore, w.opts.git_index)
+			if err != nil {
+				log.Warn(err)
+			}
+		}
+	}
+
+	// Check if path and its context are unchanged since the last run
+	var cached *cache.Entry
+	if w.state != nil {
+		if entry.IsDir() {
+			ctx_fp = cache.CtxFingerprint(ctx_fp, ctx_inputs, entry.Stat)
+			dir.ctx_fp = ctx_fp
+		}
+		cached = w.state.Get(real, info, ctx_fp)
+	}
+	if cached != nil {
+		if entry.IsDir() {
+			for ns, ctx_ns := range ctx {
+				ctx_ns.Delete("tags")
+				tags, ok := cached.CtxTags[ns]
+				if ok {
+					ctx_ns.AddTags(tags)
+				}
+			}
+		} else {
+			log.Tracef(" - file: %v, unchanged, tags: %v", path, cached.Tags)
+		}
+		return
+	}
+
+	// Files are tagged by worker pool, dirs - right here, as their context is needed for traversal
+	if entry.Mode & os.ModeType == 0 || symlink_tag {
+		if symlink_tag {
+			ctx_ns(ctx, "link").AddTags([]string{"symlink"})
+			w.explain.tagged(path, "link", "symlink_tag", []string{"symlink"})
+		} else if real != path {
+			// Taggers should see resolved path, e.g. for file extension of symlink target
+			entry = tgrs.NewEntry(real, entry.Mode, info, w.listings)
+		}
+		w.pending.Add(1)
+		w.jobs <- &walk_job{seq: w.seq, path: real, entry: entry, info: info, ctx: ctx, ctx_fp: ctx_fp}
+		w.seq++
+		return
+	}
+
+	w.run_taggers(entry, ctx)
+	if conf != nil {
+		for ns, tags := range conf.apply_tags(ctx) {
+			w.explain.tagged(path, ns, dir_config_name, tags)
+		}
+	}
+
+	if w.state != nil && entry.IsDir() {
+		cached := cache.Entry{CtxTags: make(map[string][]string, len(ctx))}
+		for ns, ctx_ns := range ctx {
+			for tag, _ := range ctx_ns.Tags() {
+				cached.CtxTags[ns] = append(cached.CtxTags[ns], tag)
+			}
+		}
+		w.state.Set(real, info, ctx_fp, &cached)
+	}
+
+	return
+}
+
+// Process path, following symlink (if enabled) to process resolved path after symlink itself.
+// Returned entry is for the resolved path in that case.
+func (w *walker) process_entry(entry *tgrs.Entry, parent *walk_dir) (*tgrs.Entry, *walk_dir, bool) {
+	dir, ok := w.process(entry, parent, "")
+	if ok && entry.Mode & os.ModeSymlink != 0 && w.opts.follow_symlinks {
+		target, err := filepath.EvalSymlinks(entry.Path)
+		var info os.FileInfo
+		if err == nil {
+			info, err = os.Stat(target)
+		}
+		if err != nil {
+			w.log.Debugf(" - path: %v, failed to resolve symlink: %v", entry.Path, err)
+			return entry, nil, false
+		}
+		// Paths within configured ones are processed there, with context of their own parent dirs
+		if w.within_roots(target) {
+			w.log.Tracef(" - path: %v, symlink not followed, as its target is within configured path", entry.Path)
+			w.explain.note(entry.Path, "symlink not followed, as its target is within configured path: %v", target)
+			return entry, dir, ok
+		}
+		entry = tgrs.NewEntry(entry.Path, info.Mode(), info, w.listings)
+		dir, ok = w.process(entry, parent, target)
+	}
+	return entry, dir, ok
+}
+
+// Check whether resolved path is within any of the configured paths.
+func (w *walker) within_roots(path string) bool {
+	for _, root := range w.roots_real {
+		if path == root || strings.HasPrefix(path, root + string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Process path and everything under it, if it's a directory.
+func (w *walker) walk_entry(entry *tgrs.Entry, parent *walk_dir) {
+	entry, dir, ok := w.process_entry(entry, parent)
+	if !ok || dir == nil {
+		return
+	}
+	// Only dir itself is of interest, when it's explained
+	if w.explain != nil {
+		w.explain.result = ctx_tags(dir.ctx)
+		return
+	}
+	listing := w.listings.Get(entry.Path)
+	if listing.Err != nil {
+		w.log.Debugf(" - path: %v, error: %v", entry.Path, listing.Err)
+	}
+	for _, dir_entry := range listing.Entries {
+		w.walk_entry(tgrs.NewEntry(filepath.Join(entry.Path, dir_entry.Name()),
+			dir_entry.Type(), nil, w.listings), dir)
+	}
+	w.listings.Drop(entry.Path)
+}
+
+// Create Entry for the path, which doesn't come from a directory listing.
+func (w *walker) entry_new(path string) (*tgrs.Entry, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	return tgrs.NewEntry(path, info.Mode(), info, w.listings), nil
+}
+
+// Build VCS ignore-lists for the root path from dirs above it, if root is within repository.
+func (w *walker) ignore_root(root string) (matcher *ignore.Matcher) {
+	if !w.opts.vcs_ignore && !w.opts.git_index {
+		return
+	}
+	dirs := []string{}
+	for dir := root; ; {
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return
+		}
+		dir = parent
+		dirs = append(dirs, dir)
+		entry, err := w.entry_new(dir)
+		if err != nil {
+			return
+		}
+		_, git := entry.Contains(".git")
+		_, hg := entry.Contains(".hg")
+		if git || hg {
+			break
+		}
+	}
+	defer w.listings.Drop(dirs[len(dirs)-1])
+	for n := len(dirs) - 1; n >= 0; n-- {
+		entry, err := w.entry_new(dirs[n])
+		if err != nil {
+			return nil
+		}
+		matcher, err = matcher.Child(dirs[n], entry.Contains, w.opts.vcs_ignore, w.opts.git_index)
+		if err != nil {
+			w.log.Warn(err)
+		}
+	}
+	return
+}
+
+// Process all paths within the root.
+func (w *walker) walk(root string) {
+	w.log.Tracef("Processing path: %s", root)
+	w.root, w.opts = root, w.config.root_opts(root)
+	entry, err := w.entry_new(root)
+	if err != nil {
+		w.log.Errorf("Failed to process path (%s): %v", root, err)
+	} else {
+		w.walk_entry(entry, nil)
+	}
+	w.flush()
+}
+
+// Process specific paths (and everything under these, if they're dirs) within the root.
+// Ancestor dirs of each path are processed first to build its context, same as on a full walk,
+//  but only once for all paths that have them in common.
+// Dirs processed before are skipped as overlaps, so w.seen should be reset between
+//  separate batches of paths that can have ancestor dirs in common.
+func (w *walker) walk_paths(root string, paths []string) {
+	w.root, w.opts = root, w.config.root_opts(root)
+	defer w.listings.Drop(root)
+	// Processed ancestor dirs, with nil for excluded ones
+	dirs := make(map[string]*walk_dir)
+
+	for _, path := range paths {
+		w.log.Tracef("Processing path: %s (root: %s)", path, root)
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			w.log.Errorf("Path is not within the root (%v): %v", root, path)
+			continue
+		}
+		ancestors := []string{}
+		if rel != "." {
+			ancestors = append(ancestors, root)
+			for _, slug := range strings.Split(filepath.Dir(rel), string(filepath.Separator)) {
+				if slug != "." {
+					ancestors = append(ancestors, filepath.Join(ancestors[len(ancestors)-1], slug))
+				}
+			}
+		}
+		var dir *walk_dir
+		for _, dir_path := range ancestors {
+			dir_next, ok := dirs[dir_path]
+			if !ok {
+				entry, err := w.entry_new(dir_path)
+				if err != nil {
+					w.log.Debugf(" - path: %v, error: %v", dir_path, err)
+				} else {
+					_, dir_next, _ = w.process_entry(entry, dir)
+				}
+				dirs[dir_path] = dir_next
+			}
+			if dir = dir_next; dir == nil {
+				break
+			}
+		}
+		if dir == nil && len(ancestors) > 0 {
+			w.log.Tracef(" - path: %v, skipped along with its parent dir", path)
+			w.explain.note(path, "skipped along with its parent dir")
+			continue
+		}
+
+		entry, err := w.entry_new(path)
+		if err != nil {
+			w.log.Errorf("Failed to process path (%s): %v", path, err)
+			continue
+		}
+		w.walk_entry(entry, dir)
+	}
+}
+
+// Apply all pending tags via backend and update state cache accordingly.
+func (w *walker) flush() {
+	w.pending.Wait()
+	err := w.config.backend.Flush()
+	if err != nil {
+		w.log.Errorf("Failed to apply tags for path (%s): %v", w.root, err)
+	}
+	if w.state != nil {
+		if err != nil {
+			w.state.Discard()
+		} else {
+			w.state.Commit()
+		}
+	}
+}
+
+// Write state cache to disk, if it is used.
+func (w *walker) save_state() {
+	if w.state == nil {
+		return
+	}
+	err := w.state.Save()
+	if err != nil {
+		w.log.Errorf("Failed to save state cache (%v): %v", w.state.Path, err)
+	}
+}
+
+// Stop workers, close output backend and save state cache.
+func (w *walker) close() {
+	close(w.jobs)
+	w.workers.Wait()
+	close(w.results)
+	<-w.writer_done
+	err := w.config.backend.Close()
+	if err != nil {
+		w.log.Errorf("Failed to close output backend (%v): %v", w.config.backend_name, err)
+	}
+	w.save_state()
+}
+
+// Process all configured paths, or only specified absolute paths, if any.
+// Paths within configured ones are processed along with their ancestor dirs (for context),
+//  and any other paths - as separate roots, with same filters and taggers.
+func scan(config *config_t, paths []string) (err error) {
+	w, err := walker_new(config)
+	if err != nil {
+		return
+	}
+	if len(paths) == 0 {
+		for _, root := range config.paths {
+			w.walk(root)
+		}
+		w.close()
+		return
+	}
+
+	// Group paths by configured ones that they're in, to process common ancestors once
+	roots, root_paths := []string{}, make(map[string][]string)
+	for _, path := range paths {
+		root, path_rel := config.path_root(path)
+		if len(root) == 0 {
+			root, path_rel = path, path
+		}
+		if _, ok := root_paths[root]; !ok {
+			roots = append(roots, root)
+		}
+		root_paths[root] = append(root_paths[root], path_rel)
+	}
+	for _, root := range roots {
+		w.walk_paths(root, root_paths[root])
+		w.flush()
+	}
+	w.close()
+	return
+}
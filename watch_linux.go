@@ -0,0 +1,297 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+	"path/filepath"
+	"github.com/vaughan0/go-logging"
+	"codetag/ignore"
+)
+
+
+type inotify_event struct {
+	wd int32
+	mask uint32
+	name string
+}
+
+// Reads events from inotify fd and sends these to a channel, until read fails.
+func inotify_read(fd int, events chan<- inotify_event, log *logging.Logger) {
+	buff := make([]byte, (syscall.SizeofInotifyEvent + syscall.NAME_MAX + 1) * 64)
+	for {
+		n, err := syscall.Read(fd, buff)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			log.Errorf("Failed to read inotify events: %v", err)
+			close(events)
+			return
+		}
+		for offset := 0; offset + syscall.SizeofInotifyEvent <= n; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buff[offset]))
+			name := buff[offset + syscall.SizeofInotifyEvent:
+				offset + syscall.SizeofInotifyEvent + int(raw.Len)]
+			events <- inotify_event{raw.Wd, raw.Mask, strings.TrimRight(string(name), "\x00")}
+			offset += syscall.SizeofInotifyEvent + int(raw.Len)
+		}
+	}
+}
+
+
+const watch_mask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO
+
+// Keeps track of inotify watches for processed dirs and changed paths within these.
+type watcher struct {
+	log *logging.Logger
+	fd int
+	wds map[int32]string
+	dirs map[string]int32
+	// Dirs that passed filters and were processed
+	processed map[string]bool
+	// Dirs with context inputs or ignore-lists (e.g. "dir/.git") and dirs these belong to
+	ctx_dirs map[string]string
+	// Changed paths, with "true" for ones where whole subtree should be processed
+	pending map[string]bool
+	// Set on inotify queue overflow, to re-process everything
+	rescan bool
+	limit_warned bool
+	// Paths (relative to dir) that affect tags or traversal of everything within the dir
+	inputs []string
+}
+
+func (watcher *watcher) add(path string) {
+	if _, ok := watcher.dirs[path]; ok {
+		return
+	}
+	wd, err := syscall.InotifyAddWatch(watcher.fd, path, watch_mask | syscall.IN_ONLYDIR)
+	if err != nil {
+		if err == syscall.ENOSPC {
+			if !watcher.limit_warned {
+				watcher.log.Warnf("Hit inotify watches limit (fs.inotify.max_user_watches"+
+					" sysctl), changes in some dirs won't be detected, starting with: %v", path)
+				watcher.limit_warned = true
+			}
+		} else {
+			watcher.log.Debugf("Failed to add inotify watch for path (%v): %v", path, err)
+		}
+		return
+	}
+	watcher.wds[int32(wd)], watcher.dirs[path] = path, int32(wd)
+}
+
+// Add watch for processed directory, as well as for dirs with its context inputs.
+func (watcher *watcher) add_dir(path string) {
+	watcher.processed[path] = true
+	watcher.add(path)
+	for _, input := range watcher.inputs {
+		input_dir := filepath.Dir(input)
+		if input_dir == "." {
+			continue
+		}
+		input_dir = filepath.Join(path, input_dir)
+		info, err := os.Stat(input_dir)
+		if err != nil || !info.IsDir() {
+			continue
+		}
+		watcher.ctx_dirs[input_dir] = path
+		watcher.add(input_dir)
+	}
+}
+
+func (watcher *watcher) remove_all() {
+	for wd, _ := range watcher.wds {
+		syscall.InotifyRmWatch(watcher.fd, uint32(wd))
+	}
+	watcher.wds, watcher.dirs = make(map[int32]string), make(map[string]int32)
+	watcher.processed, watcher.ctx_dirs = make(map[string]bool), make(map[string]string)
+}
+
+func (watcher *watcher) handle(ev inotify_event) {
+	if ev.mask & syscall.IN_Q_OVERFLOW != 0 {
+		watcher.log.Warn("inotify event queue overflow, will re-process all paths")
+		watcher.rescan = true
+		return
+	}
+	dir, ok := watcher.wds[ev.wd]
+	if !ok {
+		return
+	}
+	if ev.mask & syscall.IN_IGNORED != 0 {
+		delete(watcher.wds, ev.wd)
+		delete(watcher.dirs, dir)
+		delete(watcher.ctx_dirs, dir)
+		return
+	}
+	if len(ev.name) == 0 {
+		return
+	}
+	path := filepath.Join(dir, ev.name)
+	// Changed context input (e.g. .git/config) - re-process whole dir it belongs to
+	if owner, ok := watcher.ctx_dirs[dir]; ok {
+		for _, input := range watcher.inputs {
+			if filepath.Join(owner, input) == path {
+				watcher.pending[owner] = true
+			}
+		}
+	}
+	if !watcher.processed[dir] {
+		return
+	}
+	for _, input := range watcher.inputs {
+		if input == ev.name {
+			watcher.pending[dir] = true
+		}
+	}
+	if _, ok := watcher.pending[path]; !ok {
+		watcher.pending[path] = ev.mask & syscall.IN_ISDIR != 0
+	}
+}
+
+// Process all pending paths, skipping ones within already-processed dirs.
+func (watcher *watcher) process(w *walker, config *config_t) {
+	paths := make([]string, 0, len(watcher.pending))
+	for path, _ := range watcher.pending {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	// Grouped by configured paths, to process common ancestor dirs only once
+	roots, root_paths := []string{}, make(map[string][]string)
+	subtree := ""
+	for _, path := range paths {
+		if len(subtree) > 0 && strings.HasPrefix(path, subtree + string(filepath.Separator)) {
+			continue
+		}
+		if watcher.pending[path] {
+			subtree = path
+		}
+		root, _ := config.path_root(path)
+		if len(root) == 0 {
+			continue
+		}
+		if _, err := os.Lstat(path); err != nil {
+			continue
+		}
+		if _, ok := root_paths[root]; !ok {
+			roots = append(roots, root)
+		}
+		root_paths[root] = append(root_paths[root], path)
+	}
+	w.seen = make(map[file_id]string)
+	for _, root := range roots {
+		w.walk_paths(root, root_paths[root])
+	}
+	watcher.pending = make(map[string]bool)
+	w.flush()
+	w.save_state()
+}
+
+
+// Process all paths, then keep processing changed ones as inotify reports them.
+func cmd_watch(config *config_t, args []string) int {
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %v [ <options> ] watch [ --debounce <seconds> ]\n\n"+
+			"Process all configured paths, then watch these for changes via inotify,\n"+
+			"processing created/modified files, as well as whole subtrees of dirs with\n"+
+			"changed context inputs (e.g. .git/config) or filter files (e.g. .gitignore).\n"+
+			"Config is reloaded on SIGHUP.\n\n"+
+			"Options:\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	debounce := flags.Float64("debounce", 2, "Delay (in seconds) after last detected"+
+		" change before processing changed paths, to handle bursts of changes at once.")
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return 1
+	}
+
+	log := config.log
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		log.Fatalf("Failed to init inotify: %v", err)
+		return 1
+	}
+	events := make(chan inotify_event, 1024)
+	go inotify_read(fd, events, log)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+
+	watcher := watcher{log: log, fd: fd, pending: make(map[string]bool)}
+	delay := time.Duration(*debounce * float64(time.Second))
+	timer := time.NewTimer(delay)
+	timer.Stop()
+
+	for {
+		// (Re-)start with full scan of all paths
+		watcher.remove_all()
+		watcher.inputs = append(append(append([]string{},
+			ctx_inputs...), ignore.Inputs...), config.filters.merge_names()...)
+		watcher.inputs = append(append(watcher.inputs, config.markers...), "CACHEDIR.TAG")
+		watcher.rescan = false
+		w, err := walker_new(config)
+		if err != nil {
+			log.Fatal(err)
+			return 1
+		}
+		w.dir_hook = watcher.add_dir
+		for _, root := range config.paths {
+			w.walk(root)
+		}
+		w.save_state()
+		log.Debugf("Watching %d dir(s) for changes", len(watcher.dirs))
+
+		reload := false
+		for !reload {
+			select {
+				case ev, ok := <-events:
+					if !ok {
+						w.close()
+						return 1
+					}
+					watcher.handle(ev)
+					timer.Reset(delay)
+				case <-timer.C:
+					if watcher.rescan {
+						reload = true
+					} else {
+						watcher.process(w, config)
+					}
+				case sig := <-signals:
+					if sig != syscall.SIGHUP {
+						log.Debugf("Exiting on signal: %v", sig)
+						w.close()
+						return 0
+					}
+					log.Debug("Reloading configuration")
+					config_new, _, err := config_load(config.path)
+					if err != nil {
+						log.Errorf("Failed to reload configuration file, keeping old one (%q): %v", config.path, err)
+						continue
+					}
+					if config_new.taggers == nil {
+						log.Error("No 'taggers' defined in reloaded configuration, keeping old one")
+						continue
+					}
+					log = config_new.log
+					watcher.log = log
+					reload = true
+					config = config_new
+			}
+		}
+		w.close()
+		watcher.pending = make(map[string]bool)
+	}
+}
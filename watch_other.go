@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+
+// Only implemented via linux inotify.
+func cmd_watch(config *config_t, args []string) int {
+	config.log.Fatal("'watch' command is only supported on linux")
+	return 1
+}